@@ -8,6 +8,7 @@ import (
 	"rootmos.io/go-utils/logging"
 	"rootmos.io/go-utils/sealedbox"
 	"rootmos.io/sitepkg/internal/common"
+	"rootmos.io/sitepkg/internal/keyfmt"
 )
 
 func doNewKeyfile(ctx context.Context, path string, force bool) error {
@@ -27,6 +28,7 @@ func doNewKeyfile(ctx context.Context, path string, force bool) error {
 func main() {
 	newKeyfile := flag.String("new-keyfile", common.Getenv("NEW_KEYFILE"), "create new keyfile")
 	newAwsSecretsManagerSecretValue := flag.String("new-aws-secretsmanager-secret-value", common.Getenv("NEW_AWS_SECRETSMANAGER_SECRET_VALUE_ARN"), "populate the secret value of the AWS Secrets Manager Secret specified by its ARN")
+	secretFormat := flag.String("aws-secretsmanager-secret-format", common.Getenv("AWS_SECRETSMANAGER_SECRET_FORMAT"), "store the key as binary, base64 or json (the latter two as SecretString)")
 	force := flag.Bool("force", common.GetenvBool("FORCE"), "overwrite key if exists")
 	logConfig := logging.PrepareConfig(common.EnvPrefix)
 	flag.Parse()
@@ -47,7 +49,12 @@ func main() {
 	}
 
 	if *newAwsSecretsManagerSecretValue != "" {
-		if err := doNewSMSecretValue(ctx, *newAwsSecretsManagerSecretValue, *force); err != nil {
+		format, err := keyfmt.ParseFormat(*secretFormat)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := doNewSMSecretValue(ctx, *newAwsSecretsManagerSecretValue, format, *force); err != nil {
 			log.Fatal(err)
 		}
 	}
@@ -7,8 +7,10 @@ import (
 	"rootmos.io/go-utils/logging"
 	"rootmos.io/go-utils/sealedbox"
 
+	"rootmos.io/sitepkg/internal/awscfg"
+	"rootmos.io/sitepkg/internal/keyfmt"
+
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
 )
 
@@ -19,9 +21,7 @@ func getSM(ctx context.Context) (*secretsmanager.Client, error) {
 		return smClient, nil
 	}
 
-	cfg, err := config.LoadDefaultConfig(ctx,
-		config.WithEC2IMDSRegion(),
-	)
+	cfg, err := awscfg.Load(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -30,8 +30,8 @@ func getSM(ctx context.Context) (*secretsmanager.Client, error) {
 	return smClient, nil
 }
 
-func doNewSMSecretValue(ctx context.Context, arn string, force bool) error {
-	logger, ctx := logging.WithAttrs(ctx, "arn", arn)
+func doNewSMSecretValue(ctx context.Context, arn string, format keyfmt.Format, force bool) error {
+	logger, ctx := logging.WithAttrs(ctx, "arn", arn, "format", format)
 	logger.Debug("populating secretsmanager secret value")
 
 	sm, err := getSM(ctx)
@@ -81,10 +81,22 @@ func doNewSMSecretValue(ctx context.Context, arn string, force bool) error {
 	logger = logger.With("fpr", key.Fingerprint())
 	logger.Info("generated new key")
 
-	psv, err := sm.PutSecretValue(ctx, &secretsmanager.PutSecretValueInput {
+	bin, str, err := keyfmt.Encode(key, format)
+	if err != nil {
+		return err
+	}
+	defer clear(bin)
+
+	input := &secretsmanager.PutSecretValueInput {
 		SecretId: aws.String(arn),
-		SecretBinary: key.Bytes(),
-	})
+	}
+	if format == keyfmt.FormatBinary {
+		input.SecretBinary = bin
+	} else {
+		input.SecretString = aws.String(str)
+	}
+
+	psv, err := sm.PutSecretValue(ctx, input)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,34 @@
+package awscfg
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+var (
+	mu sync.Mutex
+	cfg *aws.Config
+)
+
+// Load returns the default AWS config, loading it once per process
+func Load(ctx context.Context) (aws.Config, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if cfg != nil {
+		return *cfg, nil
+	}
+
+	c, err := config.LoadDefaultConfig(ctx,
+		config.WithEC2IMDSRegion(),
+	)
+	if err != nil {
+		return aws.Config{}, err
+	}
+
+	cfg = &c
+	return c, nil
+}
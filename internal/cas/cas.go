@@ -0,0 +1,284 @@
+package cas
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"rootmos.io/go-utils/logging"
+	"rootmos.io/go-utils/sealedbox"
+
+	"rootmos.io/sitepkg/internal/storage"
+	"rootmos.io/sitepkg/manifest"
+)
+
+// The URL prefix selecting the content-addressed repository mode, e.g.
+// cas+s3://bucket/prefix or cas+file:///var/lib/sitepkg
+const Prefix = "cas+"
+
+const LatestSnapshot = "latest"
+
+// A Repository stores the content of each file as a blob keyed by its SHA256
+// (blobs/<sha256>) and a snapshot index per create (snapshots/<id>) listing
+// the tar headers of the entries together with the SHA256 of their content.
+// Blobs and indices are sealed when a key is given.
+type Repository struct {
+	URL string
+	Key *sealedbox.Key
+}
+
+type Entry struct {
+	Header *tar.Header `json:"header"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+type Snapshot struct {
+	Created time.Time `json:"created"`
+	Entries []Entry `json:"entries"`
+}
+
+func IsRepository(url string) bool {
+	return strings.HasPrefix(url, Prefix)
+}
+
+func Open(url string, key *sealedbox.Key) *Repository {
+	return &Repository {
+		URL: strings.TrimSuffix(strings.TrimPrefix(url, Prefix), "/"),
+		Key: key,
+	}
+}
+
+func (r *Repository) url(parts ...string) string {
+	return r.URL + "/" + strings.Join(parts, "/")
+}
+
+func (r *Repository) seal(bs []byte) ([]byte, error) {
+	if r.Key == nil {
+		return bs, nil
+	}
+
+	box, err := sealedbox.Seal(r.Key, bs)
+	if err != nil {
+		return nil, err
+	}
+
+	return box.MarshalBinary()
+}
+
+func (r *Repository) open(bs []byte) ([]byte, error) {
+	if r.Key == nil {
+		return bs, nil
+	}
+
+	var box sealedbox.Box
+	if err := box.UnmarshalBinary(bs); err != nil {
+		return nil, err
+	}
+
+	return box.Open(r.Key)
+}
+
+func (r *Repository) put(ctx context.Context, url string, bs []byte) error {
+	if err := storage.MkdirAll(url); err != nil {
+		return err
+	}
+
+	enc, err := r.seal(bs)
+	if err != nil {
+		return err
+	}
+
+	return storage.Create(ctx, url, bytes.NewReader(enc))
+}
+
+func (r *Repository) get(ctx context.Context, url string) ([]byte, error) {
+	f, err := storage.Open(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	enc, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.open(enc)
+}
+
+func (r *Repository) exists(ctx context.Context, url string) (bool, error) {
+	f, err := storage.Open(ctx, url)
+	if storage.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	f.Close()
+	return true, nil
+}
+
+func (r *Repository) blobURL(dgst string) string {
+	return r.url("blobs", dgst[:2], dgst)
+}
+
+// Create stores the blobs not already present in the repository followed by
+// a new snapshot index, and returns the snapshot's id
+func (r *Repository) Create(ctx context.Context, m *manifest.Manifest) (id string, err error) {
+	logger, ctx := logging.WithAttrs(ctx, "repository", r.URL)
+
+	var buf bytes.Buffer
+	if err = m.Create(ctx, &buf); err != nil {
+		return
+	}
+
+	snapshot := Snapshot {
+		Created: time.Now().UTC(),
+	}
+
+	uploaded, reused := 0, 0
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		e := Entry{ Header: hdr }
+		if hdr.Typeflag == tar.TypeReg {
+			bs, err := io.ReadAll(tr)
+			if err != nil {
+				return "", err
+			}
+
+			d := sha256.Sum256(bs)
+			e.SHA256 = hex.EncodeToString(d[:])
+
+			url := r.blobURL(e.SHA256)
+			ok, err := r.exists(ctx, url)
+			if err != nil {
+				return "", err
+			}
+
+			if ok {
+				logger.Debug("blob exists", "name", hdr.Name, "SHA256", e.SHA256)
+				reused += 1
+			} else {
+				logger.Debug("uploading blob", "name", hdr.Name, "SHA256", e.SHA256, "bytes", len(bs))
+				if err := r.put(ctx, url, bs); err != nil {
+					return "", fmt.Errorf("unable to store blob: %s: %v", e.SHA256, err)
+				}
+				uploaded += 1
+			}
+		}
+
+		snapshot.Entries = append(snapshot.Entries, e)
+	}
+
+	index, err := json.Marshal(snapshot)
+	if err != nil {
+		return
+	}
+
+	d := sha256.Sum256(index)
+	id = fmt.Sprintf("%s-%s", snapshot.Created.Format("20060102T150405Z"), hex.EncodeToString(d[:8]))
+
+	if err = r.put(ctx, r.url("snapshots", id), index); err != nil {
+		return "", fmt.Errorf("unable to store snapshot: %v", err)
+	}
+
+	if err = r.put(ctx, r.url("snapshots", LatestSnapshot), []byte(id)); err != nil {
+		return "", fmt.Errorf("unable to update latest snapshot: %v", err)
+	}
+
+	logger.Info("created snapshot", "id", id, "entries", len(snapshot.Entries), "uploaded", uploaded, "reused", reused)
+
+	return id, nil
+}
+
+// Snapshot fetches the index of the snapshot with the given id, or the latest one
+func (r *Repository) Snapshot(ctx context.Context, id string) (string, *Snapshot, error) {
+	if id == "" || id == LatestSnapshot {
+		bs, err := r.get(ctx, r.url("snapshots", LatestSnapshot))
+		if err != nil {
+			return "", nil, fmt.Errorf("unable to resolve latest snapshot: %w", err)
+		}
+		id = strings.TrimSpace(string(bs))
+	}
+
+	bs, err := r.get(ctx, r.url("snapshots", id))
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to fetch snapshot: %s: %w", id, err)
+	}
+
+	var s Snapshot
+	if err := json.Unmarshal(bs, &s); err != nil {
+		return "", nil, fmt.Errorf("unable to parse snapshot: %s: %v", id, err)
+	}
+
+	return id, &s, nil
+}
+
+// WriteTo reassembles the snapshot into a tarball
+func (r *Repository) WriteTo(ctx context.Context, s *Snapshot, w io.Writer) (err error) {
+	tw := tar.NewWriter(w)
+	defer func() {
+		if e := tw.Close(); err == nil {
+			err = e
+		}
+	}()
+
+	for _, e := range s.Entries {
+		if err = tw.WriteHeader(e.Header); err != nil {
+			return
+		}
+
+		if e.SHA256 == "" {
+			continue
+		}
+
+		bs, err := r.get(ctx, r.blobURL(e.SHA256))
+		if err != nil {
+			return fmt.Errorf("unable to fetch blob: %s: %w", e.SHA256, err)
+		}
+
+		d := sha256.Sum256(bs)
+		if actual := hex.EncodeToString(d[:]); actual != e.SHA256 {
+			return fmt.Errorf("blob SHA256 mismatch: %s != %s (expected)", actual, e.SHA256)
+		}
+
+		if _, err = tw.Write(bs); err != nil {
+			return err
+		}
+	}
+
+	return
+}
+
+func (r *Repository) Extract(ctx context.Context, m *manifest.Manifest, id string) error {
+	logger, ctx := logging.WithAttrs(ctx, "repository", r.URL)
+
+	id, s, err := r.Snapshot(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("extracting snapshot", "id", id, "created", s.Created)
+
+	var buf bytes.Buffer
+	if err := r.WriteTo(ctx, s, &buf); err != nil {
+		return err
+	}
+
+	return m.Extract(ctx, &buf)
+}
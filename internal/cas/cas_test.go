@@ -0,0 +1,142 @@
+package cas
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"rootmos.io/go-utils/sealedbox"
+
+	logging "rootmos.io/go-utils/logging/testing"
+
+	"rootmos.io/sitepkg/manifest"
+)
+
+var seed = time.Now().UnixNano()
+var prng = rand.New(rand.NewSource(seed))
+
+func Must0(err error) {
+	if err != nil {
+		log.Fatalf("a must failed: %v", err)
+	}
+}
+
+func Must[T any](obj T, err error) T {
+	if err != nil {
+		log.Fatalf("a must failed: %v", err)
+	}
+	return obj
+}
+
+func PopulateFile(path string) []byte {
+	Must0(os.MkdirAll(filepath.Dir(path), 0755))
+	bs := make([]byte, 1 + prng.Intn(4096))
+	_ = Must(prng.Read(bs))
+	Must0(os.WriteFile(path, bs, 0644))
+	return bs
+}
+
+func CountBlobs(t *testing.T, repo string) (n int) {
+	Must0(filepath.Walk(filepath.Join(repo, "blobs"), func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			n += 1
+		}
+		return err
+	}))
+	return
+}
+
+func CheckFile(t *testing.T, path string, bs []byte) {
+	if !bytes.Equal(Must(os.ReadFile(path)), bs) {
+		t.Errorf("content mismatch: %s", path)
+	}
+}
+
+func TestIncrementalSnapshots(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	key := Must(sealedbox.NewKey())
+	defer key.Close()
+
+	tmp := t.TempDir()
+	a := filepath.Join(tmp, "a")
+	foo0 := PopulateFile(filepath.Join(a, "foo"))
+	bar := PopulateFile(filepath.Join(a, "bar"))
+
+	m0 := &manifest.Manifest {
+		Root: a,
+		Paths: []string{ "foo", "bar" },
+	}
+
+	path := filepath.Join(tmp, "repo")
+	repo := Open(Prefix + "file://" + path, key)
+
+	id0, err := repo.Create(ctx, m0)
+	if err != nil {
+		t.Fatalf("unable to create snapshot: %v", err)
+	}
+
+	if n := CountBlobs(t, path); n != 2 {
+		t.Errorf("unexpected number of blobs: %d", n)
+	}
+
+	foo1 := PopulateFile(filepath.Join(a, "foo"))
+	if _, err := repo.Create(ctx, m0); err != nil {
+		t.Fatalf("unable to create snapshot: %v", err)
+	}
+
+	if n := CountBlobs(t, path); n != 3 {
+		t.Errorf("unexpected number of blobs: %d", n)
+	}
+
+	b := filepath.Join(tmp, "b")
+	Must0(os.Mkdir(b, 0755))
+	m1 := &manifest.Manifest {
+		Root: b,
+		Paths: []string{ "foo", "bar" },
+	}
+
+	if err := repo.Extract(ctx, m1, ""); err != nil {
+		t.Fatalf("unable to extract latest snapshot: %v", err)
+	}
+	CheckFile(t, filepath.Join(b, "foo"), foo1)
+	CheckFile(t, filepath.Join(b, "bar"), bar)
+
+	if err := repo.Extract(ctx, m1, id0); err != nil {
+		t.Fatalf("unable to extract snapshot: %v", err)
+	}
+	CheckFile(t, filepath.Join(b, "foo"), foo0)
+	CheckFile(t, filepath.Join(b, "bar"), bar)
+}
+
+func TestWrongKey(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	key0 := Must(sealedbox.NewKey())
+	defer key0.Close()
+	key1 := Must(sealedbox.NewKey())
+	defer key1.Close()
+
+	tmp := t.TempDir()
+	a := filepath.Join(tmp, "a")
+	_ = PopulateFile(filepath.Join(a, "foo"))
+
+	m := &manifest.Manifest {
+		Root: a,
+		Paths: []string{ "foo" },
+	}
+
+	url := Prefix + filepath.Join(tmp, "repo")
+	if _, err := Open(url, key0).Create(ctx, m); err != nil {
+		t.Fatalf("unable to create snapshot: %v", err)
+	}
+
+	if err := Open(url, key1).Extract(ctx, m, ""); err == nil {
+		t.Errorf("unexpected success")
+	}
+}
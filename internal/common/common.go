@@ -2,6 +2,8 @@ package common
 
 import (
 	"os"
+	"strconv"
+	"time"
 )
 
 const (
@@ -25,3 +27,27 @@ func Getenv2(key string, def string) string {
 func GetenvBool(key string) bool {
 	return Getenv(key) != ""
 }
+
+func GetenvInt(key string, def int) int {
+	v, isset := os.LookupEnv(EnvPrefix + key)
+	if !isset {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return def
+	}
+	return i
+}
+
+func GetenvDuration(key string, def time.Duration) time.Duration {
+	v, isset := os.LookupEnv(EnvPrefix + key)
+	if !isset {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return def
+	}
+	return d
+}
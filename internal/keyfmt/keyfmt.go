@@ -0,0 +1,128 @@
+package keyfmt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"rootmos.io/go-utils/sealedbox"
+)
+
+type Format int
+
+const (
+	FormatBinary Format = iota
+	FormatBase64
+	FormatJSON
+)
+
+const (
+	JSONKeyField = "sitepkg_key"
+	JSONKeyIdField = "key_id"
+)
+
+type jsonKey struct {
+	Key string `json:"sitepkg_key"`
+	KeyId string `json:"key_id,omitempty"`
+}
+
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "", "binary":
+		return FormatBinary, nil
+	case "base64":
+		return FormatBase64, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return 0, fmt.Errorf("unsupported key format: %s", s)
+}
+
+func (f Format) String() string {
+	switch f {
+	case FormatBinary:
+		return "binary"
+	case FormatBase64:
+		return "base64"
+	case FormatJSON:
+		return "json"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// Encode returns the key either as bytes (FormatBinary) or as a string (the
+// other formats), suitable for SecretBinary respectively SecretString
+func Encode(key *sealedbox.Key, f Format) (bin []byte, str string, err error) {
+	switch f {
+	case FormatBinary:
+		return bytes.Clone(key.Bytes()), "", nil
+	case FormatBase64:
+		return nil, base64.StdEncoding.EncodeToString(key.Bytes()), nil
+	case FormatJSON:
+		bs, err := json.Marshal(jsonKey {
+			Key: base64.StdEncoding.EncodeToString(key.Bytes()),
+			KeyId: key.Fingerprint(),
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		return nil, string(bs), nil
+	}
+	return nil, "", fmt.Errorf("unsupported key format: %v", f)
+}
+
+// DecodeString auto-detects whether s is a JSON object or plain base64
+func DecodeString(s string) (key *sealedbox.Key, f Format, err error) {
+	t := strings.TrimSpace(s)
+
+	var raw []byte
+	var keyId string
+	if strings.HasPrefix(t, "{") {
+		f = FormatJSON
+		var j jsonKey
+		if err = json.Unmarshal([]byte(t), &j); err != nil {
+			return nil, f, fmt.Errorf("unable to parse key as JSON: %v", err)
+		}
+		if j.Key == "" {
+			return nil, f, fmt.Errorf("JSON key without field: %s", JSONKeyField)
+		}
+		raw, err = base64.StdEncoding.DecodeString(j.Key)
+		keyId = j.KeyId
+	} else {
+		f = FormatBase64
+		raw, err = base64.StdEncoding.DecodeString(t)
+	}
+	defer clear(raw)
+	if err != nil {
+		return nil, f, fmt.Errorf("unable to decode key as base64: %v", err)
+	}
+
+	key, err = sealedbox.KeyFromBytes(raw)
+	if err != nil {
+		return nil, f, err
+	}
+
+	// before Close zeroes the key
+	if fp := key.Fingerprint(); keyId != "" && keyId != fp {
+		key.Close()
+		return nil, f, fmt.Errorf("%s mismatch: %s != %s", JSONKeyIdField, keyId, fp)
+	}
+
+	return key, f, nil
+}
+
+// Decode prefers bin when present, falling back to DecodeString
+func Decode(bin []byte, str *string) (*sealedbox.Key, Format, error) {
+	if bin != nil {
+		key, err := sealedbox.KeyFromBytes(bin)
+		return key, FormatBinary, err
+	}
+
+	if str != nil {
+		return DecodeString(*str)
+	}
+
+	return nil, 0, fmt.Errorf("neither binary nor string key present")
+}
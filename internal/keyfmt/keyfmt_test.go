@@ -0,0 +1,96 @@
+package keyfmt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"log"
+	"strings"
+	"testing"
+
+	"rootmos.io/go-utils/sealedbox"
+)
+
+func Must[T any](obj T, err error) T {
+	if err != nil {
+		log.Fatalf("a must failed: %v", err)
+	}
+	return obj
+}
+
+func roundtrip(t *testing.T, f Format) {
+	key0 := Must(sealedbox.NewKey())
+	defer key0.Close()
+
+	bin, str, err := Encode(key0, f)
+	if err != nil {
+		t.Fatalf("unable to encode key: %v", err)
+	}
+
+	var sp *string
+	if bin == nil {
+		sp = &str
+	}
+
+	key1, g, err := Decode(bin, sp)
+	if err != nil {
+		t.Fatalf("unable to decode key: %v", err)
+	}
+	defer key1.Close()
+
+	if f != g {
+		t.Errorf("format mismatch: %v != %v", f, g)
+	}
+
+	if !bytes.Equal(key0.Bytes(), key1.Bytes()) {
+		t.Errorf("key mismatch")
+	}
+}
+
+func TestRoundtripBinary(t *testing.T) {
+	roundtrip(t, FormatBinary)
+}
+
+func TestRoundtripBase64(t *testing.T) {
+	roundtrip(t, FormatBase64)
+}
+
+func TestRoundtripJSON(t *testing.T) {
+	roundtrip(t, FormatJSON)
+}
+
+func TestJSONWithoutKeyId(t *testing.T) {
+	key0 := Must(sealedbox.NewKey())
+	defer key0.Close()
+
+	s := `{"sitepkg_key": "` + base64.StdEncoding.EncodeToString(key0.Bytes()) + `"}`
+	key1, _, err := DecodeString(s)
+	if err != nil {
+		t.Fatalf("unable to decode key: %v", err)
+	}
+	defer key1.Close()
+
+	if !bytes.Equal(key0.Bytes(), key1.Bytes()) {
+		t.Errorf("key mismatch")
+	}
+}
+
+func TestJSONKeyIdMismatch(t *testing.T) {
+	key := Must(sealedbox.NewKey())
+	defer key.Close()
+
+	s := `{"sitepkg_key": "` + base64.StdEncoding.EncodeToString(key.Bytes()) + `", "key_id": "00000000000000"}`
+	_, _, err := DecodeString(s)
+	if err == nil {
+		t.Fatalf("unexpected success")
+	}
+	if !strings.Contains(err.Error(), key.Fingerprint()) {
+		t.Errorf("fingerprint of the key not reported: %v", err)
+	}
+}
+
+func TestInvalidLength(t *testing.T) {
+	s := base64.StdEncoding.EncodeToString([]byte("too short"))
+	if _, _, err := DecodeString(s); err == nil {
+		t.Errorf("unexpected success")
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package keyprovider
 
 import (
 	"context"
@@ -7,17 +7,17 @@ import (
 	"rootmos.io/go-utils/sealedbox"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+
+	"rootmos.io/sitepkg/internal/awscfg"
+	"rootmos.io/sitepkg/internal/keyfmt"
 )
 
 func getKeyFromSMSecretValue(ctx context.Context, arn string) (*sealedbox.Key, error) {
 	logger, ctx := logging.WithAttrs(ctx, "arn", arn)
 	logger.Debug("fetching key")
 
-	cfg, err := config.LoadDefaultConfig(ctx,
-		config.WithEC2IMDSRegion(),
-	)
+	cfg, err := awscfg.Load(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -39,12 +39,16 @@ func getKeyFromSMSecretValue(ctx context.Context, arn string) (*sealedbox.Key, e
 
 	logger.Debug("fetched secret value", "version", aws.ToString(gsv.VersionId))
 
-	key, err := sealedbox.KeyFromBytes(gsv.SecretBinary)
+	key, f, err := keyfmt.Decode(gsv.SecretBinary, gsv.SecretString)
 	if err != nil {
 		return nil, err
 	}
 
-	logger.Info("fetched key", "fpr", key.Fingerprint())
+	logger.Debug("decoded key", "format", f)
 
 	return key, nil
 }
+
+func init() {
+	Register("awssm", ProviderFunc(getKeyFromSMSecretValue))
+}
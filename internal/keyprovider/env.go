@@ -0,0 +1,23 @@
+package keyprovider
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"rootmos.io/go-utils/sealedbox"
+
+	"rootmos.io/sitepkg/internal/keyfmt"
+)
+
+func init() {
+	Register("env", ProviderFunc(func(ctx context.Context, name string) (*sealedbox.Key, error) {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("environment variable not set: %s", name)
+		}
+
+		key, _, err := keyfmt.DecodeString(v)
+		return key, err
+	}))
+}
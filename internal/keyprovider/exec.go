@@ -0,0 +1,38 @@
+package keyprovider
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"rootmos.io/go-utils/sealedbox"
+
+	"rootmos.io/sitepkg/internal/keyfmt"
+)
+
+// the helper is expected to write the key to stdout, either as raw bytes or
+// in any of the string formats understood by keyfmt
+func execHelper(ctx context.Context, path string) (*sealedbox.Key, error) {
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	defer func() { clear(stdout.Bytes()) }()
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("key helper failed: %s: %v", path, err)
+	}
+
+	if stdout.Len() == sealedbox.KeySize {
+		return sealedbox.KeyFromBytes(stdout.Bytes())
+	}
+
+	key, _, err := keyfmt.DecodeString(stdout.String())
+	return key, err
+}
+
+func init() {
+	Register("exec", ProviderFunc(execHelper))
+}
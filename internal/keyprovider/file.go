@@ -0,0 +1,13 @@
+package keyprovider
+
+import (
+	"context"
+
+	"rootmos.io/go-utils/sealedbox"
+)
+
+func init() {
+	Register("file", ProviderFunc(func(ctx context.Context, path string) (*sealedbox.Key, error) {
+		return sealedbox.LoadKeyfile(path)
+	}))
+}
@@ -0,0 +1,120 @@
+package keyprovider
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"rootmos.io/go-utils/logging"
+	"rootmos.io/go-utils/sealedbox"
+)
+
+// A Provider fetches a key given the part of the key URL following "scheme://"
+type Provider interface {
+	Key(ctx context.Context, ref string) (*sealedbox.Key, error)
+}
+
+type ProviderFunc func(ctx context.Context, ref string) (*sealedbox.Key, error)
+
+func (f ProviderFunc) Key(ctx context.Context, ref string) (*sealedbox.Key, error) {
+	return f(ctx, ref)
+}
+
+var (
+	providersMu sync.RWMutex
+	providers = make(map[string]Provider)
+)
+
+func Register(scheme string, p Provider) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
+	if _, ok := providers[scheme]; ok {
+		panic(fmt.Sprintf("key provider already registered: %s", scheme))
+	}
+	providers[scheme] = p
+}
+
+func Schemes() (ss []string) {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+
+	for s := range providers {
+		ss = append(ss, s)
+	}
+	sort.Strings(ss)
+	return
+}
+
+func lookup(scheme string) (Provider, error) {
+	providersMu.RLock()
+	p, ok := providers[scheme]
+	providersMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unsupported key provider: %s (supported: %s)", scheme, strings.Join(Schemes(), ", "))
+	}
+	return p, nil
+}
+
+// Split separates a key URL into its scheme and reference, treating URLs
+// without a scheme as paths to keyfiles
+func Split(url string) (scheme, ref string) {
+	i := strings.Index(url, "://")
+	if i < 0 {
+		return "file", url
+	}
+	return url[:i], url[i+3:]
+}
+
+// A Keyring caches fetched keys and zeroizes all of them when closed
+type Keyring struct {
+	mu sync.Mutex
+	keys map[string]*sealedbox.Key
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring {
+		keys: make(map[string]*sealedbox.Key),
+	}
+}
+
+// Get returns the key for the URL; it is owned by the keyring and must not be closed by the caller
+func (kr *Keyring) Get(ctx context.Context, url string) (*sealedbox.Key, error) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	if key, ok := kr.keys[url]; ok {
+		return key, nil
+	}
+
+	scheme, ref := Split(url)
+	logger, ctx := logging.WithAttrs(ctx, "provider", scheme)
+
+	p, err := lookup(scheme)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debug("fetching key")
+	key, err := p.Key(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("fetched key", "fpr", key.Fingerprint())
+
+	kr.keys[url] = key
+	return key, nil
+}
+
+func (kr *Keyring) Close() {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	for url, key := range kr.keys {
+		key.Close()
+		delete(kr.keys, url)
+	}
+}
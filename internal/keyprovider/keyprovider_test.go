@@ -0,0 +1,144 @@
+package keyprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"rootmos.io/go-utils/sealedbox"
+
+	logging "rootmos.io/go-utils/logging/testing"
+)
+
+func Must0(err error) {
+	if err != nil {
+		log.Fatalf("a must failed: %v", err)
+	}
+}
+
+func Must[T any](obj T, err error) T {
+	if err != nil {
+		log.Fatalf("a must failed: %v", err)
+	}
+	return obj
+}
+
+func TestSplit(t *testing.T) {
+	for _, c := range []struct{ url, scheme, ref string } {
+		{ "/path/to/keyfile", "file", "/path/to/keyfile" },
+		{ "file:///path/to/keyfile", "file", "/path/to/keyfile" },
+		{ "awssm://arn:aws:secretsmanager:eu-central-1:123456789012:secret:foo", "awssm", "arn:aws:secretsmanager:eu-central-1:123456789012:secret:foo" },
+		{ "ssm:///sitepkg/key", "ssm", "/sitepkg/key" },
+		{ "env://SITEPKG_TEST_KEY", "env", "SITEPKG_TEST_KEY" },
+	} {
+		scheme, ref := Split(c.url)
+		if scheme != c.scheme || ref != c.ref {
+			t.Errorf("unexpected split of %s: (%s, %s) != (%s, %s)", c.url, scheme, ref, c.scheme, c.ref)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	path := filepath.Join(t.TempDir(), "keyfile")
+	key0 := Must(sealedbox.NewKeyfile(path, false))
+	defer key0.Close()
+
+	kr := NewKeyring()
+	defer kr.Close()
+
+	key1, err := kr.Get(ctx, "file://" + path)
+	if err != nil {
+		t.Fatalf("unable to get key: %v", err)
+	}
+
+	if !bytes.Equal(key0.Bytes(), key1.Bytes()) {
+		t.Errorf("key mismatch")
+	}
+}
+
+func TestEnv(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	key0 := Must(sealedbox.NewKey())
+	defer key0.Close()
+	t.Setenv("SITEPKG_TEST_KEY", base64.StdEncoding.EncodeToString(key0.Bytes()))
+
+	kr := NewKeyring()
+	defer kr.Close()
+
+	key1, err := kr.Get(ctx, "env://SITEPKG_TEST_KEY")
+	if err != nil {
+		t.Fatalf("unable to get key: %v", err)
+	}
+
+	if !bytes.Equal(key0.Bytes(), key1.Bytes()) {
+		t.Errorf("key mismatch")
+	}
+}
+
+func TestExec(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	path := filepath.Join(tmp, "keyfile")
+	key0 := Must(sealedbox.NewKeyfile(path, false))
+	defer key0.Close()
+
+	helper := filepath.Join(tmp, "helper")
+	if err := os.WriteFile(helper, []byte("#!/bin/sh\nexec cat " + path + "\n"), 0755); err != nil {
+		t.Fatalf("unable to write helper: %v", err)
+	}
+
+	kr := NewKeyring()
+	defer kr.Close()
+
+	key1, err := kr.Get(ctx, "exec://" + helper)
+	if err != nil {
+		t.Fatalf("unable to get key: %v", err)
+	}
+
+	if !bytes.Equal(key0.Bytes(), key1.Bytes()) {
+		t.Errorf("key mismatch")
+	}
+}
+
+func TestCachedAndZeroized(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	path := filepath.Join(t.TempDir(), "keyfile")
+	key0 := Must(sealedbox.NewKeyfile(path, false))
+	defer key0.Close()
+
+	kr := NewKeyring()
+
+	key1 := Must(kr.Get(ctx, path))
+	Must0(os.Remove(path))
+	key2 := Must(kr.Get(ctx, path))
+
+	if key1 != key2 {
+		t.Errorf("key not cached")
+	}
+
+	kr.Close()
+
+	if !bytes.Equal(key1.Bytes(), make([]byte, sealedbox.KeySize)) {
+		t.Errorf("key not zeroized")
+	}
+}
+
+func TestUnsupportedScheme(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	kr := NewKeyring()
+	defer kr.Close()
+
+	if _, err := kr.Get(ctx, "nope://foo"); err == nil {
+		t.Errorf("unexpected success")
+	}
+}
@@ -0,0 +1,44 @@
+package keyprovider
+
+import (
+	"context"
+
+	"rootmos.io/go-utils/logging"
+	"rootmos.io/go-utils/sealedbox"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+
+	"rootmos.io/sitepkg/internal/awscfg"
+	"rootmos.io/sitepkg/internal/keyfmt"
+)
+
+// the parameter is expected to be a SecureString holding the key as base64 or JSON
+func getKeyFromSSMParameter(ctx context.Context, name string) (*sealedbox.Key, error) {
+	logger, ctx := logging.WithAttrs(ctx, "parameter", name)
+	logger.Debug("fetching key")
+
+	cfg, err := awscfg.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c := ssm.NewFromConfig(cfg)
+
+	gp, err := c.GetParameter(ctx, &ssm.GetParameterInput {
+		Name: aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debug("fetched parameter", "version", gp.Parameter.Version)
+
+	key, _, err := keyfmt.DecodeString(aws.ToString(gp.Parameter.Value))
+	return key, err
+}
+
+func init() {
+	Register("ssm", ProviderFunc(getKeyFromSSMParameter))
+}
@@ -0,0 +1,134 @@
+package rollback
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"rootmos.io/go-utils/logging"
+	"rootmos.io/go-utils/sealedbox"
+
+	"rootmos.io/sitepkg/manifest"
+)
+
+// Archives are stored as <dir>/<timestamp>.tar, or .tar.enc when sealed
+const timeFormat = "20060102T150405.000000000Z"
+
+type Archive struct {
+	Path string
+	Time time.Time
+	Sealed bool
+}
+
+func List(dir string) (as []Archive, err error) {
+	des, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+
+	for _, de := range des {
+		n := de.Name()
+		sealed := strings.HasSuffix(n, ".tar.enc")
+		ts := strings.TrimSuffix(strings.TrimSuffix(n, ".enc"), ".tar")
+		t, err := time.Parse(timeFormat, ts)
+		if err != nil || !de.Type().IsRegular() {
+			continue
+		}
+		as = append(as, Archive{ Path: filepath.Join(dir, n), Time: t, Sealed: sealed })
+	}
+
+	sort.Slice(as, func(i, j int) bool {
+		return as[i].Time.After(as[j].Time)
+	})
+
+	return
+}
+
+func Save(ctx context.Context, dir string, tarball []byte, key *sealedbox.Key) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	name := time.Now().UTC().Format(timeFormat) + ".tar"
+	bs := tarball
+	if key != nil {
+		box, err := sealedbox.Seal(key, tarball)
+		if err != nil {
+			return "", err
+		}
+		if bs, err = box.MarshalBinary(); err != nil {
+			return "", err
+		}
+		name += ".enc"
+	}
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, bs, 0600); err != nil {
+		return "", err
+	}
+
+	logging.Get(ctx).Info("saved rollback archive", "path", path, "bytes", len(bs))
+	return path, nil
+}
+
+func (a Archive) load(key *sealedbox.Key) ([]byte, error) {
+	bs, err := os.ReadFile(a.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !a.Sealed {
+		return bs, nil
+	}
+
+	if key == nil {
+		return nil, fmt.Errorf("sealed rollback archive but no key: %s", a.Path)
+	}
+
+	var box sealedbox.Box
+	if err := box.UnmarshalBinary(bs); err != nil {
+		return nil, err
+	}
+	return box.Open(key)
+}
+
+// Restore rolls back the n latest extractions, newest first, removing each
+// archive once applied
+func Restore(ctx context.Context, dir, root string, n int, key *sealedbox.Key) error {
+	as, err := List(dir)
+	if err != nil {
+		return err
+	}
+
+	if n > len(as) {
+		return fmt.Errorf("only %d rollback archive(s) available: %s", len(as), dir)
+	}
+
+	for _, a := range as[:n] {
+		logger, ctx := logging.WithAttrs(ctx, "archive", a.Path)
+		logger.Info("rolling back", "extracted", a.Time)
+
+		bs, err := a.load(key)
+		if err != nil {
+			return fmt.Errorf("unable to load rollback archive: %s: %v", a.Path, err)
+		}
+
+		if err := manifest.Rollback(ctx, root, bytes.NewReader(bs)); err != nil {
+			return fmt.Errorf("unable to roll back: %s: %v", a.Path, err)
+		}
+
+		if err := os.Remove(a.Path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,292 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"rootmos.io/go-utils/logging"
+)
+
+var ErrNotModified = errors.New("not modified")
+
+// NotModifiedError is returned by Open when a conditional request reports that
+// the package is unchanged since it was last committed
+type NotModifiedError struct {
+	URL string
+	SHA256 []byte
+}
+
+func (e *NotModifiedError) Error() string {
+	return fmt.Sprintf("not modified: %s", e.URL)
+}
+
+func (e *NotModifiedError) Is(target error) bool {
+	return target == ErrNotModified
+}
+
+// HTTP fetches packages over HTTP(S), resuming interrupted downloads using
+// range requests, and when StateDir is set making conditional requests
+// (If-None-Match/If-Modified-Since) against the last committed fetch
+type HTTP struct {
+	Client *http.Client
+	StateDir string
+	Retries int
+	Backoff time.Duration
+}
+
+type httpState struct {
+	URL string `json:"url"`
+	ETag string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+func (h *HTTP) client() *http.Client {
+	if h.Client == nil {
+		return http.DefaultClient
+	}
+	return h.Client
+}
+
+func (h *HTTP) statePath(url string) string {
+	if h.StateDir == "" {
+		return ""
+	}
+	k := sha256.Sum256([]byte(url))
+	return filepath.Join(h.StateDir, hex.EncodeToString(k[:]) + ".json")
+}
+
+func (h *HTTP) loadState(url string) (st httpState, err error) {
+	path := h.statePath(url)
+	if path == "" {
+		return
+	}
+
+	bs, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(bs, &st)
+	return
+}
+
+func (h *HTTP) saveState(st httpState) error {
+	path := h.statePath(st.URL)
+	if path == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(h.StateDir, 0700); err != nil {
+		return err
+	}
+
+	bs, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, bs, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// do performs the request, retrying on transport errors and server errors
+func (h *HTTP) do(ctx context.Context, mkreq func() (*http.Request, error)) (rsp *http.Response, err error) {
+	logger := logging.Get(ctx)
+
+	backoff := h.Backoff
+	if backoff == 0 {
+		backoff = time.Second
+	}
+
+	for attempt := 0; ; attempt++ {
+		var req *http.Request
+		req, err = mkreq()
+		if err != nil {
+			return nil, err
+		}
+
+		rsp, err = h.client().Do(req)
+		if err == nil && rsp.StatusCode < 500 {
+			return rsp, nil
+		}
+		if err == nil {
+			rsp.Body.Close()
+			err = fmt.Errorf("unexpected status: %s", rsp.Status)
+		}
+
+		if attempt >= h.Retries {
+			return nil, err
+		}
+
+		logger.Warn("request failed; retrying", "err", err, "attempt", attempt + 1, "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (h *HTTP) Open(ctx context.Context, url string) (io.ReadCloser, error) {
+	logger, ctx := logging.WithAttrs(ctx, "url", url)
+
+	prev, err := h.loadState(url)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load HTTP state: %v", err)
+	}
+
+	rsp, err := h.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if prev.ETag != "" {
+			req.Header.Set("If-None-Match", prev.ETag)
+		}
+		if prev.LastModified != "" {
+			req.Header.Set("If-Modified-Since", prev.LastModified)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch rsp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		rsp.Body.Close()
+		logger.Debug("not modified", "etag", prev.ETag, "last-modified", prev.LastModified)
+		dgst, _ := hex.DecodeString(prev.SHA256)
+		return nil, &NotModifiedError{ URL: url, SHA256: dgst }
+	case http.StatusNotFound, http.StatusGone:
+		rsp.Body.Close()
+		return nil, fmt.Errorf("%w: %s: %s", fs.ErrNotExist, url, rsp.Status)
+	default:
+		rsp.Body.Close()
+		return nil, fmt.Errorf("unexpected status: %s: %s", url, rsp.Status)
+	}
+
+	b := &httpBody {
+		h: h,
+		ctx: ctx,
+		url: url,
+		rsp: rsp,
+		state: httpState {
+			URL: url,
+			ETag: rsp.Header.Get("ETag"),
+			LastModified: rsp.Header.Get("Last-Modified"),
+		},
+	}
+
+	logger.Debug("fetching", "etag", b.state.ETag, "last-modified", b.state.LastModified, "length", rsp.ContentLength)
+
+	return &Object {
+		ReadCloser: b,
+		commit: func(dgst []byte) error {
+			b.state.SHA256 = hex.EncodeToString(dgst)
+			return h.saveState(b.state)
+		},
+	}, nil
+}
+
+func (h *HTTP) Create(ctx context.Context, url string, r io.Reader) error {
+	return fmt.Errorf("unable to create packages over HTTP: %s", url)
+}
+
+// httpBody resumes the download using a range request when reading fails
+type httpBody struct {
+	h *HTTP
+	ctx context.Context
+	url string
+	rsp *http.Response
+	state httpState
+	off int64
+	resumes int
+}
+
+func (b *httpBody) Read(p []byte) (int, error) {
+	n, err := b.rsp.Body.Read(p)
+	b.off += int64(n)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+
+	if b.resumes >= b.h.Retries {
+		return n, err
+	}
+	b.resumes += 1
+
+	logging.Get(b.ctx).Warn("download interrupted; resuming", "err", err, "offset", b.off, "attempt", b.resumes)
+	b.rsp.Body.Close()
+
+	if rerr := b.resume(); rerr != nil {
+		return n, fmt.Errorf("unable to resume download (%v): %v", err, rerr)
+	}
+
+	return n, nil
+}
+
+func (b *httpBody) resume() error {
+	rsp, err := b.h.do(b.ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(b.ctx, http.MethodGet, b.url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", b.off))
+		if b.state.ETag != "" {
+			req.Header.Set("If-Range", b.state.ETag)
+		} else if b.state.LastModified != "" {
+			req.Header.Set("If-Range", b.state.LastModified)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	switch rsp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the range was ignored, or the content changed under our feet
+		rsp.Body.Close()
+		return fmt.Errorf("server did not honor range request")
+	default:
+		rsp.Body.Close()
+		return fmt.Errorf("unexpected status: %s", rsp.Status)
+	}
+
+	b.rsp = rsp
+	return nil
+}
+
+func (b *httpBody) Close() error {
+	return b.rsp.Body.Close()
+}
+
+var DefaultHTTP = &HTTP {
+	Retries: 3,
+}
+
+func init() {
+	Register("http", DefaultHTTP)
+	Register("https", DefaultHTTP)
+}
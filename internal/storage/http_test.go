@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	logging "rootmos.io/go-utils/logging/testing"
+)
+
+func serve(t *testing.T, bs []byte, handler func(w http.ResponseWriter, r *http.Request) bool) (*httptest.Server, *int) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests += 1
+		if handler != nil && handler(w, r) {
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "package", time.Unix(0, 0), bytes.NewReader(bs))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestHTTPConditional(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	bs := FreshBytes(4096)
+	srv, requests := serve(t, bs, nil)
+
+	h := &HTTP{ StateDir: t.TempDir() }
+
+	r, err := h.Open(ctx, srv.URL)
+	if err != nil {
+		t.Fatalf("unable to open: %v", err)
+	}
+	if !bytes.Equal(Must(io.ReadAll(r)), bs) {
+		t.Errorf("content mismatch")
+	}
+	r.Close()
+
+	// not committed: expect a full fetch
+	r, err = h.Open(ctx, srv.URL)
+	if err != nil {
+		t.Fatalf("unable to open: %v", err)
+	}
+	_ = Must(io.ReadAll(r))
+	r.Close()
+
+	dgst := sha256.Sum256(bs)
+	if err := Commit(r, dgst[:]); err != nil {
+		t.Fatalf("unable to commit: %v", err)
+	}
+
+	_, err = h.Open(ctx, srv.URL)
+	var nme *NotModifiedError
+	if !errors.As(err, &nme) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(nme.SHA256, dgst[:]) {
+		t.Errorf("SHA256 mismatch")
+	}
+
+	if *requests != 3 {
+		t.Errorf("unexpected number of requests: %d", *requests)
+	}
+}
+
+func TestHTTPResume(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	bs := make([]byte, 1 << 16)
+	_ = Must(prng.Read(bs))
+
+	srv, requests := serve(t, bs, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("Range") != "" {
+			return false
+		}
+		// promise everything but deliver only half
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", fmt.Sprint(len(bs)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(bs[:len(bs)/2])
+		panic(http.ErrAbortHandler)
+	})
+
+	h := &HTTP{ Retries: 1 }
+
+	r, err := h.Open(ctx, srv.URL)
+	if err != nil {
+		t.Fatalf("unable to open: %v", err)
+	}
+	defer r.Close()
+
+	if !bytes.Equal(Must(io.ReadAll(r)), bs) {
+		t.Errorf("content mismatch")
+	}
+
+	if *requests != 2 {
+		t.Errorf("unexpected number of requests: %d", *requests)
+	}
+}
+
+func TestHTTPNotExist(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	srv, _ := serve(t, nil, func(w http.ResponseWriter, r *http.Request) bool {
+		http.NotFound(w, r)
+		return true
+	})
+
+	h := &HTTP{}
+	if _, err := h.Open(ctx, srv.URL); !IsNotExist(err) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
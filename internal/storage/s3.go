@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"strings"
+	"sync"
+
+	"rootmos.io/go-utils/logging"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+
+	"rootmos.io/sitepkg/internal/awscfg"
+)
+
+// the user-defined object metadata key holding the hex encoded SHA256 of the package
+const S3MetadataSHA256 = "sha256"
+
+type S3Client interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+// S3 stores packages as objects: s3://bucket/key
+type S3 struct {
+	Client S3Client
+
+	ContentType string
+	SSEKMSKeyId string
+	StorageClass string
+	// URL query encoded, e.g. "foo=bar&baz=qux"
+	Tagging string
+	// refuse to overwrite an existing object (If-None-Match: *)
+	CreateOnly bool
+
+	mu sync.Mutex
+}
+
+func (s *S3) client(ctx context.Context) (S3Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Client == nil {
+		cfg, err := awscfg.Load(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.Client = s3.NewFromConfig(cfg)
+	}
+
+	return s.Client, nil
+}
+
+func ParseS3URL(raw string) (bucket, key string, err error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return
+	}
+
+	if u.Scheme != "s3" {
+		return "", "", fmt.Errorf("not an S3 URL: %s", raw)
+	}
+
+	bucket = u.Host
+	key = strings.TrimPrefix(u.Path, "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("S3 URL without bucket: %s", raw)
+	}
+
+	return
+}
+
+func (s *S3) Open(ctx context.Context, raw string) (io.ReadCloser, error) {
+	bucket, key, err := ParseS3URL(raw)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return nil, fmt.Errorf("S3 URL without key: %s", raw)
+	}
+
+	c, err := s.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	logger, ctx := logging.WithAttrs(ctx, "bucket", bucket, "key", key)
+	logger.Debug("fetching object")
+
+	o, err := c.GetObject(ctx, &s3.GetObjectInput {
+		Bucket: aws.String(bucket),
+		Key: aws.String(key),
+	})
+	var nsk *types.NoSuchKey
+	if errors.As(err, &nsk) {
+		return nil, fmt.Errorf("%w: %s: %v", fs.ErrNotExist, raw, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	obj := &Object {
+		ReadCloser: o.Body,
+	}
+
+	if h, ok := o.Metadata[S3MetadataSHA256]; ok {
+		obj.SHA256, err = hex.DecodeString(h)
+		if err != nil {
+			o.Body.Close()
+			return nil, fmt.Errorf("unable to decode SHA256 object metadata: %s", h)
+		}
+	}
+
+	logger.Debug("fetched object", "version", aws.ToString(o.VersionId), "SHA256", hex.EncodeToString(obj.SHA256))
+
+	return obj, nil
+}
+
+func (s *S3) Create(ctx context.Context, raw string, r io.Reader) error {
+	bucket, key, err := ParseS3URL(raw)
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		return fmt.Errorf("S3 URL without key: %s", raw)
+	}
+
+	bs, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	dgst := ExpectedSHA256(r)
+	if dgst == nil {
+		d := sha256.Sum256(bs)
+		dgst = d[:]
+	}
+
+	c, err := s.client(ctx)
+	if err != nil {
+		return err
+	}
+
+	input := &s3.PutObjectInput {
+		Bucket: aws.String(bucket),
+		Key: aws.String(key),
+		Body: bytes.NewReader(bs),
+		Metadata: map[string]string {
+			S3MetadataSHA256: hex.EncodeToString(dgst),
+		},
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+		ChecksumSHA256: aws.String(base64.StdEncoding.EncodeToString(dgst)),
+	}
+
+	if s.ContentType != "" {
+		input.ContentType = aws.String(s.ContentType)
+	}
+	if s.SSEKMSKeyId != "" {
+		input.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+		input.SSEKMSKeyId = aws.String(s.SSEKMSKeyId)
+	}
+	if s.StorageClass != "" {
+		input.StorageClass = types.StorageClass(s.StorageClass)
+	}
+	if s.Tagging != "" {
+		input.Tagging = aws.String(s.Tagging)
+	}
+
+	var opts []func(*s3.Options)
+	if s.CreateOnly {
+		opts = append(opts, s3.WithAPIOptions(smithyhttp.AddHeaderValue("If-None-Match", "*")))
+	}
+
+	o, err := c.PutObject(ctx, input, opts...)
+	var ae smithy.APIError
+	if errors.As(err, &ae) && ae.ErrorCode() == "PreconditionFailed" {
+		return fmt.Errorf("%w: %s", fs.ErrExist, raw)
+	}
+	if err != nil {
+		return err
+	}
+
+	logging.Get(ctx).Info("put object", "bucket", bucket, "key", key, "version", aws.ToString(o.VersionId), "etag", aws.ToString(o.ETag))
+
+	return nil
+}
+
+func (s *S3) List(ctx context.Context, raw string) (names []string, err error) {
+	bucket, prefix, err := ParseS3URL(raw)
+	if err != nil {
+		return
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	c, err := s.client(ctx)
+	if err != nil {
+		return
+	}
+
+	p := s3.NewListObjectsV2Paginator(c, &s3.ListObjectsV2Input {
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+		Delimiter: aws.String("/"),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, o := range page.Contents {
+			names = append(names, strings.TrimPrefix(aws.ToString(o.Key), prefix))
+		}
+	}
+
+	return
+}
+
+func (s *S3) Remove(ctx context.Context, raw string) error {
+	bucket, key, err := ParseS3URL(raw)
+	if err != nil {
+		return err
+	}
+
+	c, err := s.client(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.DeleteObject(ctx, &s3.DeleteObjectInput {
+		Bucket: aws.String(bucket),
+		Key: aws.String(key),
+	})
+	return err
+}
+
+var DefaultS3 = &S3{}
+
+func init() {
+	Register("s3", DefaultS3)
+}
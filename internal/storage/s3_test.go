@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	logging "rootmos.io/go-utils/logging/testing"
+)
+
+type fakeS3Object struct {
+	body []byte
+	input *s3.PutObjectInput
+}
+
+type fakeS3 struct {
+	objects map[string]fakeS3Object
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3 {
+		objects: make(map[string]fakeS3Object),
+	}
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	o, ok := f.objects[aws.ToString(in.Bucket) + "/" + aws.ToString(in.Key)]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+
+	return &s3.GetObjectOutput {
+		Body: io.NopCloser(bytes.NewReader(o.body)),
+		Metadata: o.input.Metadata,
+	}, nil
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	bs, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	f.objects[aws.ToString(in.Bucket) + "/" + aws.ToString(in.Key)] = fakeS3Object {
+		body: bs,
+		input: in,
+	}
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) ListObjectsV2(ctx context.Context, in *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	var out s3.ListObjectsV2Output
+	prefix := aws.ToString(in.Bucket) + "/" + aws.ToString(in.Prefix)
+	for k := range f.objects {
+		if rest, ok := strings.CutPrefix(k, prefix); ok && !strings.Contains(rest, "/") {
+			out.Contents = append(out.Contents, types.Object {
+				Key: aws.String(strings.TrimPrefix(k, aws.ToString(in.Bucket) + "/")),
+			})
+		}
+	}
+	return &out, nil
+}
+
+func (f *fakeS3) DeleteObject(ctx context.Context, in *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	delete(f.objects, aws.ToString(in.Bucket) + "/" + aws.ToString(in.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func TestS3ListAndRemove(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+	s := &S3{ Client: newFakeS3() }
+
+	for _, k := range []string{ "site/a", "site/b", "site/sub/c", "other" } {
+		if err := s.Create(ctx, "s3://bucket/" + k, bytes.NewReader(FreshBytes(16))); err != nil {
+			t.Fatalf("unable to create: %v", err)
+		}
+	}
+
+	if err := s.Remove(ctx, "s3://bucket/site/b"); err != nil {
+		t.Fatalf("unable to remove: %v", err)
+	}
+
+	names, err := s.List(ctx, "s3://bucket/site")
+	if err != nil {
+		t.Fatalf("unable to list: %v", err)
+	}
+	if len(names) != 1 || names[0] != "a" {
+		t.Errorf("unexpected listing: %v", names)
+	}
+}
+
+func TestS3Metadata(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+	f := newFakeS3()
+	s := &S3 {
+		Client: f,
+		ContentType: "application/octet-stream",
+		SSEKMSKeyId: "alias/sitepkg",
+		StorageClass: "STANDARD_IA",
+		Tagging: "foo=bar",
+	}
+
+	bs := FreshBytes(4096)
+	dgst := sha256.Sum256(bs)
+	if err := s.Create(ctx, "s3://bucket/site.tar.gz.enc", NewObject(bytes.NewReader(bs), dgst[:])); err != nil {
+		t.Fatalf("unable to create: %v", err)
+	}
+
+	in := f.objects["bucket/site.tar.gz.enc"].input
+	if aws.ToString(in.ChecksumSHA256) != base64.StdEncoding.EncodeToString(dgst[:]) {
+		t.Errorf("unexpected checksum: %s", aws.ToString(in.ChecksumSHA256))
+	}
+	if in.ServerSideEncryption != types.ServerSideEncryptionAwsKms || aws.ToString(in.SSEKMSKeyId) != "alias/sitepkg" {
+		t.Errorf("unexpected SSE: %s %s", in.ServerSideEncryption, aws.ToString(in.SSEKMSKeyId))
+	}
+	if in.StorageClass != types.StorageClassStandardIa {
+		t.Errorf("unexpected storage class: %s", in.StorageClass)
+	}
+
+	r, err := s.Open(ctx, "s3://bucket/site.tar.gz.enc")
+	if err != nil {
+		t.Fatalf("unable to open: %v", err)
+	}
+	defer r.Close()
+
+	if !bytes.Equal(ExpectedSHA256(r), dgst[:]) {
+		t.Errorf("SHA256 metadata mismatch")
+	}
+}
+
+func TestS3NotExist(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+	s := &S3{ Client: newFakeS3() }
+
+	if _, err := s.Open(ctx, "s3://bucket/missing"); !IsNotExist(err) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestS3CreateOnly(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	objects := make(map[string]bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if objects[r.URL.Path] && r.Header.Get("If-None-Match") == "*" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>PreconditionFailed</Code><Message>At least one of the pre-conditions you specified did not hold</Message></Error>`)
+			return
+		}
+		objects[r.URL.Path] = true
+	}))
+	defer srv.Close()
+
+	client := s3.New(s3.Options {
+		BaseEndpoint: aws.String(srv.URL),
+		Region: "us-east-1",
+		UsePathStyle: true,
+		Credentials: aws.AnonymousCredentials{},
+	})
+
+	s := &S3{ Client: client }
+	for i := 0; i < 2; i++ {
+		if err := s.Create(ctx, "s3://bucket/site", bytes.NewReader(FreshBytes(16))); err != nil {
+			t.Fatalf("unable to overwrite: %v", err)
+		}
+	}
+
+	s = &S3{ Client: client, CreateOnly: true }
+	if err := s.Create(ctx, "s3://bucket/new", bytes.NewReader(FreshBytes(16))); err != nil {
+		t.Fatalf("unable to create: %v", err)
+	}
+	if err := s.Create(ctx, "s3://bucket/site", bytes.NewReader(FreshBytes(16))); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
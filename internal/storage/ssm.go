@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"rootmos.io/go-utils/logging"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+
+	"rootmos.io/sitepkg/internal/awscfg"
+)
+
+// the largest value accepted by an Advanced parameter
+const SSMMaxValueSize = 8192
+
+type SSMClient interface {
+	GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error)
+	PutParameter(ctx context.Context, params *ssm.PutParameterInput, optFns ...func(*ssm.Options)) (*ssm.PutParameterOutput, error)
+}
+
+// SSM stores packages base64 encoded as SecureString parameters, where each
+// Create produces a new parameter version:
+// ssm:///path/to/parameter (latest) or ssm:///path/to/parameter?version=3
+type SSM struct {
+	Client SSMClient
+	KeyId string
+
+	mu sync.Mutex
+}
+
+func (s *SSM) client(ctx context.Context) (SSMClient, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Client == nil {
+		cfg, err := awscfg.Load(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.Client = ssm.NewFromConfig(cfg)
+	}
+
+	return s.Client, nil
+}
+
+func ParseSSMURL(raw string) (name string, version int64, err error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return
+	}
+
+	if u.Scheme != "ssm" {
+		return "", 0, fmt.Errorf("not an SSM URL: %s", raw)
+	}
+
+	name = u.Host + u.Path
+	if name == "" {
+		return "", 0, fmt.Errorf("SSM URL without parameter name: %s", raw)
+	}
+
+	if v := u.Query().Get("version"); v != "" {
+		version, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return "", 0, fmt.Errorf("unable to parse SSM parameter version: %s", v)
+		}
+	}
+
+	return
+}
+
+func (s *SSM) Open(ctx context.Context, raw string) (io.ReadCloser, error) {
+	name, version, err := ParseSSMURL(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := s.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	selector := name
+	if version != 0 {
+		selector = fmt.Sprintf("%s:%d", name, version)
+	}
+
+	logger, ctx := logging.WithAttrs(ctx, "parameter", selector)
+	logger.Debug("fetching parameter")
+
+	gp, err := c.GetParameter(ctx, &ssm.GetParameterInput {
+		Name: aws.String(selector),
+		WithDecryption: aws.Bool(true),
+	})
+	var pnf *types.ParameterNotFound
+	var pvnf *types.ParameterVersionNotFound
+	if errors.As(err, &pnf) || errors.As(err, &pvnf) {
+		return nil, fmt.Errorf("%w: %s: %v", fs.ErrNotExist, selector, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debug("fetched parameter", "version", gp.Parameter.Version)
+
+	bs, err := base64.StdEncoding.DecodeString(aws.ToString(gp.Parameter.Value))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode parameter value: %v", err)
+	}
+
+	return io.NopCloser(bytes.NewReader(bs)), nil
+}
+
+func (s *SSM) Create(ctx context.Context, raw string, r io.Reader) error {
+	name, version, err := ParseSSMURL(raw)
+	if err != nil {
+		return err
+	}
+	if version != 0 {
+		return fmt.Errorf("unable to create a specific SSM parameter version: %s", raw)
+	}
+
+	bs, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	value := base64.StdEncoding.EncodeToString(bs)
+	if len(value) > SSMMaxValueSize {
+		return fmt.Errorf("package too large for an SSM parameter: %d > %d (encoded)", len(value), SSMMaxValueSize)
+	}
+
+	c, err := s.client(ctx)
+	if err != nil {
+		return err
+	}
+
+	input := &ssm.PutParameterInput {
+		Name: aws.String(name),
+		Value: aws.String(value),
+		Type: types.ParameterTypeSecureString,
+		Tier: types.ParameterTierIntelligentTiering,
+		Overwrite: aws.Bool(true),
+	}
+	if s.KeyId != "" {
+		input.KeyId = aws.String(s.KeyId)
+	}
+
+	pp, err := c.PutParameter(ctx, input)
+	if err != nil {
+		return err
+	}
+
+	logging.Get(ctx).Info("put parameter", "parameter", name, "version", pp.Version, "tier", pp.Tier)
+
+	return nil
+}
+
+var DefaultSSM = &SSM{}
+
+func init() {
+	Register("ssm", DefaultSSM)
+}
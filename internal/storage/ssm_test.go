@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+
+	logging "rootmos.io/go-utils/logging/testing"
+)
+
+var seed = time.Now().UnixNano()
+var prng = rand.New(rand.NewSource(seed))
+
+func Must[T any](obj T, err error) T {
+	if err != nil {
+		log.Fatalf("a must failed: %v", err)
+	}
+	return obj
+}
+
+func FreshBytes(n int) []byte {
+	bs := make([]byte, prng.Intn(n))
+	_ = Must(prng.Read(bs))
+	return bs
+}
+
+// a local stand-in for SSM Parameter Store keeping every version
+type fakeSSM struct {
+	params map[string][]string
+}
+
+func newFakeSSM() *fakeSSM {
+	return &fakeSSM {
+		params: make(map[string][]string),
+	}
+}
+
+func (f *fakeSSM) GetParameter(ctx context.Context, in *ssm.GetParameterInput, _ ...func(*ssm.Options)) (*ssm.GetParameterOutput, error) {
+	name := aws.ToString(in.Name)
+	var version int64
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		fmt.Sscanf(name[i+1:], "%d", &version)
+		name = name[:i]
+	}
+
+	vs, ok := f.params[name]
+	if !ok {
+		return nil, &types.ParameterNotFound{}
+	}
+	if version == 0 {
+		version = int64(len(vs))
+	}
+	if version < 1 || version > int64(len(vs)) {
+		return nil, &types.ParameterVersionNotFound{}
+	}
+
+	return &ssm.GetParameterOutput {
+		Parameter: &types.Parameter {
+			Name: aws.String(name),
+			Value: aws.String(vs[version-1]),
+			Version: version,
+			Type: types.ParameterTypeSecureString,
+		},
+	}, nil
+}
+
+func (f *fakeSSM) PutParameter(ctx context.Context, in *ssm.PutParameterInput, _ ...func(*ssm.Options)) (*ssm.PutParameterOutput, error) {
+	name := aws.ToString(in.Name)
+	if _, ok := f.params[name]; ok && !aws.ToBool(in.Overwrite) {
+		return nil, &types.ParameterAlreadyExists{}
+	}
+	if in.Type != types.ParameterTypeSecureString {
+		return nil, fmt.Errorf("unexpected parameter type: %s", in.Type)
+	}
+
+	f.params[name] = append(f.params[name], aws.ToString(in.Value))
+	return &ssm.PutParameterOutput {
+		Version: int64(len(f.params[name])),
+		Tier: in.Tier,
+	}, nil
+}
+
+func read(t *testing.T, s *SSM, ctx context.Context, url string) []byte {
+	r, err := s.Open(ctx, url)
+	if err != nil {
+		t.Fatalf("unable to open: %s: %v", url, err)
+	}
+	defer r.Close()
+	return Must(io.ReadAll(r))
+}
+
+func TestParseSSMURL(t *testing.T) {
+	for _, c := range []struct{ url, name string; version int64 } {
+		{ "ssm:///path/to/param", "/path/to/param", 0 },
+		{ "ssm:///path/to/param?version=3", "/path/to/param", 3 },
+		{ "ssm://param", "param", 0 },
+	} {
+		name, version, err := ParseSSMURL(c.url)
+		if err != nil {
+			t.Errorf("unable to parse: %s: %v", c.url, err)
+		}
+		if name != c.name || version != c.version {
+			t.Errorf("unexpected parse of %s: (%s, %d) != (%s, %d)", c.url, name, version, c.name, c.version)
+		}
+	}
+}
+
+func TestSSMRoundtripVersions(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+	s := &SSM{ Client: newFakeSSM() }
+
+	url := "ssm:///sitepkg/test"
+	bs1 := FreshBytes(4096)
+	bs2 := FreshBytes(4096)
+
+	if err := s.Create(ctx, url, bytes.NewReader(bs1)); err != nil {
+		t.Fatalf("unable to create: %v", err)
+	}
+	if err := s.Create(ctx, url, bytes.NewReader(bs2)); err != nil {
+		t.Fatalf("unable to create: %v", err)
+	}
+
+	if !bytes.Equal(read(t, s, ctx, url), bs2) {
+		t.Errorf("latest version mismatch")
+	}
+	if !bytes.Equal(read(t, s, ctx, url + "?version=1"), bs1) {
+		t.Errorf("version 1 mismatch")
+	}
+	if !bytes.Equal(read(t, s, ctx, url + "?version=2"), bs2) {
+		t.Errorf("version 2 mismatch")
+	}
+}
+
+func TestSSMNotExist(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+	s := &SSM{ Client: newFakeSSM() }
+
+	if _, err := s.Open(ctx, "ssm:///sitepkg/missing"); !IsNotExist(err) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestSSMTooLarge(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+	s := &SSM{ Client: newFakeSSM() }
+
+	bs := make([]byte, SSMMaxValueSize)
+	if err := s.Create(ctx, "ssm:///sitepkg/large", bytes.NewReader(bs)); err == nil {
+		t.Errorf("unexpected success")
+	}
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"rootmos.io/go-utils/osext"
+)
+
+// A Backend stores packages at URLs with a particular scheme; URLs without a
+// registered backend are handled by osext
+type Backend interface {
+	Open(ctx context.Context, url string) (io.ReadCloser, error)
+	Create(ctx context.Context, url string, r io.Reader) error
+}
+
+// An Object carries the SHA256 of its content when known by the backend or
+// the producer, which is then verified by readers respectively stored by backends
+type Object struct {
+	io.ReadCloser
+	SHA256 []byte
+
+	commit func(sha256 []byte) error
+}
+
+func NewObject(r io.Reader, sha256 []byte) *Object {
+	return &Object {
+		ReadCloser: io.NopCloser(r),
+		SHA256: sha256,
+	}
+}
+
+func ExpectedSHA256(r io.Reader) []byte {
+	if o, ok := r.(*Object); ok {
+		return o.SHA256
+	}
+	return nil
+}
+
+// Commit informs the backend that the content of r, having the specified
+// SHA256, has been successfully applied
+func Commit(r io.Reader, sha256 []byte) error {
+	if o, ok := r.(*Object); ok && o.commit != nil {
+		return o.commit(sha256)
+	}
+	return nil
+}
+
+var (
+	backendsMu sync.RWMutex
+	backends = make(map[string]Backend)
+)
+
+func Register(scheme string, b Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if _, ok := backends[scheme]; ok {
+		panic(fmt.Sprintf("storage backend already registered: %s", scheme))
+	}
+	backends[scheme] = b
+}
+
+func Scheme(url string) string {
+	i := strings.Index(url, "://")
+	if i < 0 {
+		return ""
+	}
+	return url[:i]
+}
+
+func lookup(url string) Backend {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	return backends[Scheme(url)]
+}
+
+func Open(ctx context.Context, url string) (io.ReadCloser, error) {
+	if b := lookup(url); b != nil {
+		return b.Open(ctx, url)
+	}
+	return osext.Open(ctx, url)
+}
+
+func Create(ctx context.Context, url string, r io.Reader) error {
+	if b := lookup(url); b != nil {
+		return b.Create(ctx, url, r)
+	}
+	return osext.Create(ctx, url, r)
+}
+
+// Backends able to enumerate and delete packages additionally implement Lister respectively Remover
+type Lister interface {
+	// List returns the names of the packages directly below the URL
+	List(ctx context.Context, url string) ([]string, error)
+}
+
+type Remover interface {
+	Remove(ctx context.Context, url string) error
+}
+
+func IsLocal(url string) bool {
+	s := Scheme(url)
+	return s == "" || s == "file"
+}
+
+func LocalPath(url string) string {
+	return strings.TrimPrefix(url, "file://")
+}
+
+// MkdirAll creates the parent directories of local URLs
+func MkdirAll(url string) error {
+	if !IsLocal(url) {
+		return nil
+	}
+	return os.MkdirAll(filepath.Dir(LocalPath(url)), 0755)
+}
+
+func List(ctx context.Context, url string) ([]string, error) {
+	if IsLocal(url) {
+		des, err := os.ReadDir(LocalPath(url))
+		if err != nil {
+			return nil, err
+		}
+
+		var names []string
+		for _, de := range des {
+			if de.Type().IsRegular() {
+				names = append(names, de.Name())
+			}
+		}
+		return names, nil
+	}
+
+	if l, ok := lookup(url).(Lister); ok {
+		names, err := l.List(ctx, url)
+		sort.Strings(names)
+		return names, err
+	}
+
+	return nil, fmt.Errorf("unable to list: %s", url)
+}
+
+func Remove(ctx context.Context, url string) error {
+	if IsLocal(url) {
+		return os.Remove(LocalPath(url))
+	}
+
+	if r, ok := lookup(url).(Remover); ok {
+		return r.Remove(ctx, url)
+	}
+
+	return fmt.Errorf("unable to remove: %s", url)
+}
+
+func IsNotExist(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || osext.IsNotExist(err)
+}
@@ -0,0 +1,224 @@
+package versions
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"rootmos.io/go-utils/logging"
+
+	"rootmos.io/sitepkg/internal/storage"
+)
+
+// the object, next to the versions, naming the latest version
+const Latest = "latest"
+
+const timeFormat = "20060102T150405Z"
+
+// A Version is a package stored as <prefix>/<timestamp>-<sha256><suffix>
+type Version struct {
+	Name string
+	Time time.Time
+	SHA256 string
+}
+
+var nameRegexp = regexp.MustCompile(`^(\d{8}T\d{6}Z)-([0-9a-f]{64})(\..*)?$`)
+
+func Name(t time.Time, sha256 []byte, suffix string) string {
+	return fmt.Sprintf("%s-%s%s", t.UTC().Format(timeFormat), hex.EncodeToString(sha256), suffix)
+}
+
+func Parse(name string) (v Version, ok bool) {
+	m := nameRegexp.FindStringSubmatch(name)
+	if m == nil {
+		return
+	}
+
+	t, err := time.Parse(timeFormat, m[1])
+	if err != nil {
+		return
+	}
+
+	return Version{ Name: name, Time: t, SHA256: m[2] }, true
+}
+
+func URL(prefix, name string) string {
+	return strings.TrimSuffix(prefix, "/") + "/" + name
+}
+
+// List returns the versions below the prefix, newest first
+func List(ctx context.Context, prefix string) (vs []Version, err error) {
+	names, err := storage.List(ctx, prefix)
+	if err != nil {
+		return
+	}
+
+	for _, n := range names {
+		if v, ok := Parse(n); ok {
+			vs = append(vs, v)
+		}
+	}
+
+	sort.Slice(vs, func(i, j int) bool {
+		return vs[i].Time.After(vs[j].Time)
+	})
+
+	return
+}
+
+func GetLatest(ctx context.Context, prefix string) (string, error) {
+	f, err := storage.Open(ctx, URL(prefix, Latest))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	bs, err := io.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(bs)), nil
+}
+
+func SetLatest(ctx context.Context, prefix, name string) error {
+	url := URL(prefix, Latest)
+	if err := storage.MkdirAll(url); err != nil {
+		return err
+	}
+	return storage.Create(ctx, url, bytes.NewReader([]byte(name + "\n")))
+}
+
+// Resolve returns the URL of the specified version, or of the latest when
+// empty; a version may be abbreviated to any unique prefix of its name
+func Resolve(ctx context.Context, prefix, version string) (string, error) {
+	if version == "" || version == Latest {
+		name, err := GetLatest(ctx, prefix)
+		if err != nil {
+			return "", fmt.Errorf("unable to resolve latest version: %w", err)
+		}
+		return URL(prefix, name), nil
+	}
+
+	if _, ok := Parse(version); ok {
+		return URL(prefix, version), nil
+	}
+
+	vs, err := List(ctx, prefix)
+	if err != nil {
+		return "", err
+	}
+
+	var match *Version
+	for i, v := range vs {
+		if strings.HasPrefix(v.Name, version) {
+			if match != nil {
+				return "", fmt.Errorf("ambiguous version: %s (%s, %s)", version, match.Name, v.Name)
+			}
+			match = &vs[i]
+		}
+	}
+
+	if match == nil {
+		return "", fmt.Errorf("no such version: %s", version)
+	}
+
+	return URL(prefix, match.Name), nil
+}
+
+// A Policy keeps the Latest newest versions together with the newest version
+// of each of the Daily most recent days and the Weekly most recent (ISO) weeks
+type Policy struct {
+	Latest int
+	Daily int
+	Weekly int
+}
+
+// Select partitions versions, given newest first, into those to keep and those to prune
+func (p Policy) Select(vs []Version) (keep, prune []Version) {
+	keeping := make(map[string]bool)
+
+	for i := 0; i < p.Latest && i < len(vs); i++ {
+		keeping[vs[i].Name] = true
+	}
+
+	bucket := func(n int, key func(time.Time) string) {
+		seen := make(map[string]bool)
+		for _, v := range vs {
+			if len(seen) >= n {
+				break
+			}
+			k := key(v.Time)
+			if !seen[k] {
+				seen[k] = true
+				keeping[v.Name] = true
+			}
+		}
+	}
+
+	bucket(p.Daily, func(t time.Time) string {
+		return t.UTC().Format("2006-01-02")
+	})
+
+	bucket(p.Weekly, func(t time.Time) string {
+		y, w := t.UTC().ISOWeek()
+		return fmt.Sprintf("%d-W%02d", y, w)
+	})
+
+	for _, v := range vs {
+		if keeping[v.Name] {
+			keep = append(keep, v)
+		} else {
+			prune = append(prune, v)
+		}
+	}
+
+	return
+}
+
+// Prune removes the versions not kept by the policy, never removing the latest version
+func Prune(ctx context.Context, prefix string, p Policy, dryRun bool) error {
+	logger, ctx := logging.WithAttrs(ctx, "prefix", prefix)
+
+	if p == (Policy{}) {
+		return fmt.Errorf("refusing to prune without a retention policy")
+	}
+
+	vs, err := List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	latest, err := GetLatest(ctx, prefix)
+	if err != nil && !storage.IsNotExist(err) {
+		return err
+	}
+
+	keep, prune := p.Select(vs)
+	logger.Info("applying retention policy", "versions", len(vs), "keep", len(keep), "prune", len(prune))
+
+	for _, v := range prune {
+		if v.Name == latest {
+			logger.Info("keeping latest", "version", v.Name)
+			continue
+		}
+
+		if dryRun {
+			logger.Info("would prune", "version", v.Name)
+			continue
+		}
+
+		logger.Info("pruning", "version", v.Name)
+		if err := storage.Remove(ctx, URL(prefix, v.Name)); err != nil {
+			return fmt.Errorf("unable to remove version: %s: %v", v.Name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package versions
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	logging "rootmos.io/go-utils/logging/testing"
+)
+
+func version(t time.Time) Version {
+	d := sha256.Sum256([]byte(t.String()))
+	v, ok := Parse(Name(t, d[:], ".tar.gz.enc"))
+	if !ok {
+		panic("unable to parse generated version name")
+	}
+	return v
+}
+
+func names(vs []Version) (ns []string) {
+	for _, v := range vs {
+		ns = append(ns, v.Time.Format(time.DateTime))
+	}
+	return
+}
+
+func TestParseName(t *testing.T) {
+	t0 := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	d := sha256.Sum256(nil)
+	v, ok := Parse(Name(t0, d[:], ".tar"))
+	if !ok {
+		t.Fatalf("unable to parse")
+	}
+	if !v.Time.Equal(t0) {
+		t.Errorf("time mismatch: %v != %v", v.Time, t0)
+	}
+
+	for _, n := range []string{ Latest, "foo.tar", "20240102T030405Z-abc.tar" } {
+		if _, ok := Parse(n); ok {
+			t.Errorf("unexpectedly parsed: %s", n)
+		}
+	}
+}
+
+func TestPolicySelect(t *testing.T) {
+	t0 := time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+	var vs []Version
+	// two versions a day for 30 days, newest first
+	for i := 0; i < 60; i++ {
+		vs = append(vs, version(t0.Add(-time.Duration(i) * 12 * time.Hour)))
+	}
+
+	keep, prune := Policy{ Latest: 3 }.Select(vs)
+	if len(keep) != 3 || len(prune) != 57 {
+		t.Errorf("unexpected selection: keep=%v", names(keep))
+	}
+
+	keep, _ = Policy{ Daily: 7 }.Select(vs)
+	if len(keep) != 7 {
+		t.Errorf("unexpected daily selection: %v", names(keep))
+	}
+
+	keep, _ = Policy{ Latest: 3, Daily: 2 }.Select(vs)
+	if len(keep) != 3 {
+		t.Errorf("unexpected overlapping selection: %v", names(keep))
+	}
+
+	keep, _ = Policy{ Weekly: 3 }.Select(vs)
+	if len(keep) != 3 {
+		t.Errorf("unexpected weekly selection: %v", names(keep))
+	}
+	for i := 1; i < len(keep); i++ {
+		y0, w0 := keep[i-1].Time.ISOWeek()
+		y1, w1 := keep[i].Time.ISOWeek()
+		if y0 == y1 && w0 == w1 {
+			t.Errorf("two versions kept for the same week: %v", names(keep))
+		}
+	}
+}
+
+func TestResolveAndPrune(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	prefix := t.TempDir()
+	t0 := time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+	var last string
+	for i := 0; i < 5; i++ {
+		v := version(t0.Add(-time.Duration(i) * time.Hour))
+		if err := os.WriteFile(filepath.Join(prefix, v.Name), []byte(fmt.Sprint(i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			last = v.Name
+		}
+	}
+
+	if err := SetLatest(ctx, prefix, last); err != nil {
+		t.Fatalf("unable to set latest: %v", err)
+	}
+
+	url, err := Resolve(ctx, prefix, "")
+	if err != nil || url != URL(prefix, last) {
+		t.Errorf("unexpected latest: %s (%v)", url, err)
+	}
+
+	url, err = Resolve(ctx, prefix, "20240131T1000")
+	if err != nil || !bytes.Contains([]byte(url), []byte("20240131T100000Z")) {
+		t.Errorf("unexpected resolution: %s (%v)", url, err)
+	}
+
+	if err := Prune(ctx, prefix, Policy{ Latest: 2 }, false); err != nil {
+		t.Fatalf("unable to prune: %v", err)
+	}
+
+	vs, err := List(ctx, prefix)
+	if err != nil {
+		t.Fatalf("unable to list: %v", err)
+	}
+	if len(vs) != 2 || vs[0].Name != last {
+		t.Errorf("unexpected versions after pruning: %v", names(vs))
+	}
+}
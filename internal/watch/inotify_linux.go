@@ -0,0 +1,66 @@
+package watch
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"rootmos.io/go-utils/logging"
+)
+
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+	syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_DELETE_SELF |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_MOVE_SELF
+
+// Wait blocks until any of the paths (or, for directories, their entries)
+// change and no further changes occur during the debounce duration
+func Wait(ctx context.Context, paths []string, debounce time.Duration) error {
+	logger := logging.Get(ctx)
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("unable to initialize inotify: %v", err)
+	}
+	f := os.NewFile(uintptr(fd), "inotify")
+	defer f.Close()
+
+	for _, p := range paths {
+		if _, err := syscall.InotifyAddWatch(fd, p, inotifyMask); err != nil {
+			return fmt.Errorf("unable to watch %s: %v", p, err)
+		}
+	}
+	logger.DebugContext(ctx, "watching", "paths", len(paths))
+
+	events := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent + syscall.NAME_MAX + 1))
+		for {
+			_, err := f.Read(buf)
+			select {
+			case events <- err:
+			default:
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var quiet <-chan time.Time
+	for {
+		select {
+		case err := <-events:
+			if err != nil {
+				return fmt.Errorf("unable to read inotify events: %v", err)
+			}
+			logger.DebugContext(ctx, "change detected")
+			quiet = time.After(debounce)
+		case <-quiet:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package watch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	logging "rootmos.io/go-utils/logging/testing"
+)
+
+func TestWaitDebounced(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	tmp := t.TempDir()
+	path := filepath.Join(tmp, "foo")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- Wait(ctx, []string{ tmp }, 100*time.Millisecond)
+	}()
+
+	time.Sleep(50*time.Millisecond)
+	t0 := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := os.WriteFile(path, []byte{ byte(i) }, 0644); err != nil {
+			t.Fatalf("unable to write file: %v", err)
+		}
+		time.Sleep(50*time.Millisecond)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("unable to wait: %v", err)
+	}
+
+	if d := time.Since(t0); d < 200*time.Millisecond {
+		t.Errorf("returned before debounce: %v", d)
+	}
+}
+
+func TestWaitCanceled(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+
+	if err := Wait(ctx, []string{ t.TempDir() }, time.Millisecond); err != context.DeadlineExceeded {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
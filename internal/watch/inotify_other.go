@@ -0,0 +1,13 @@
+//go:build !linux
+
+package watch
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+func Wait(ctx context.Context, paths []string, debounce time.Duration) error {
+	return fmt.Errorf("watching files is only supported on linux")
+}
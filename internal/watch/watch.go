@@ -0,0 +1,165 @@
+package watch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"rootmos.io/go-utils/logging"
+)
+
+// Status is the last known state of a watched source, written as JSON to
+// the status file after every poll
+type Status struct {
+	Source string `json:"source"`
+	SHA256 string `json:"sha256,omitempty"`
+	Applied *time.Time `json:"applied,omitempty"`
+	Checked time.Time `json:"checked"`
+	Error string `json:"error,omitempty"`
+	Failures int `json:"failures,omitempty"`
+}
+
+// A Poll checks the source, applies it when changed and returns the SHA256
+// of its content together with whether it was applied
+type Poll func(ctx context.Context) (sha256 string, applied bool, err error)
+
+// the upper bound of the backoff, relative to the interval, unless specified
+const DefaultMaxBackoffFactor = 16
+
+type Watcher struct {
+	Source string
+	// must be positive
+	Interval time.Duration
+	// upper bound of the exponential backoff after failed polls
+	MaxBackoff time.Duration
+	StatusPath string
+}
+
+// never below the interval, i.e. failed polls aren't retried sooner than successful ones
+func (w *Watcher) maxBackoff() time.Duration {
+	if w.MaxBackoff > 0 {
+		return max(w.MaxBackoff, w.Interval)
+	}
+	return DefaultMaxBackoffFactor * w.Interval
+}
+
+// Backoff returns the delay, with jitter, before the next poll after the
+// specified number of consecutive failures
+func (w *Watcher) Backoff(failures int) time.Duration {
+	limit := w.maxBackoff()
+	d := w.Interval
+	for i := 0; i < failures && d < limit; i++ {
+		d *= 2
+	}
+	if d > limit {
+		d = limit
+	}
+	if failures == 0 || d <= 1 {
+		return d
+	}
+	return max(d/2 + time.Duration(rand.Int63n(int64(d/2))), w.Interval)
+}
+
+func (w *Watcher) writeStatus(s *Status) error {
+	if w.StatusPath == "" {
+		return nil
+	}
+
+	bs, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(w.StatusPath), ".status-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(bs, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), w.StatusPath)
+}
+
+// Run polls until the context is done or SIGTERM/SIGINT is received, never
+// interrupting an ongoing poll; SIGHUP triggers an immediate poll
+func (w *Watcher) Run(ctx context.Context, poll Poll) error {
+	logger, ctx := logging.WithAttrs(ctx, "source", w.Source)
+
+	if w.Interval <= 0 {
+		return fmt.Errorf("non-positive interval: %v", w.Interval)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(term)
+
+	status := &Status {
+		Source: w.Source,
+	}
+
+	for {
+		sha256, applied, err := poll(ctx)
+
+		now := time.Now().UTC()
+		status.Checked = now
+		if err != nil {
+			status.Failures += 1
+			status.Error = err.Error()
+			logger.WarnContext(ctx, "poll failed", "err", err, "failures", status.Failures)
+		} else {
+			status.Failures = 0
+			status.Error = ""
+			if sha256 != "" {
+				status.SHA256 = sha256
+			}
+			if applied {
+				status.Applied = &now
+				logger.InfoContext(ctx, "applied", "SHA256", sha256)
+			} else {
+				logger.DebugContext(ctx, "unchanged", "SHA256", sha256)
+			}
+		}
+
+		if err := w.writeStatus(status); err != nil {
+			logger.WarnContext(ctx, "unable to write status", "err", err, "path", w.StatusPath)
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		delay := w.Backoff(status.Failures)
+		logger.DebugContext(ctx, "sleeping", "delay", delay)
+
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-hup:
+			logger.InfoContext(ctx, "SIGHUP: polling")
+			t.Stop()
+		case s := <-term:
+			logger.InfoContext(ctx, "stopping", "signal", s)
+			t.Stop()
+			return nil
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
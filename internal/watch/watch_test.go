@@ -0,0 +1,105 @@
+package watch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	logging "rootmos.io/go-utils/logging/testing"
+)
+
+func TestBackoff(t *testing.T) {
+	w := &Watcher {
+		Interval: time.Second,
+		MaxBackoff: 10*time.Second,
+	}
+
+	if d := w.Backoff(0); d != time.Second {
+		t.Errorf("unexpected delay without failures: %v", d)
+	}
+
+	for failures := 1; failures < 10; failures++ {
+		d := w.Backoff(failures)
+		if d > w.MaxBackoff {
+			t.Errorf("delay exceeds max backoff: %v > %v", d, w.MaxBackoff)
+		}
+		if d < time.Second {
+			t.Errorf("delay below interval: %v", d)
+		}
+	}
+}
+
+func TestDefaultMaxBackoff(t *testing.T) {
+	w := &Watcher{ Interval: time.Second }
+
+	if d := w.Backoff(5); d < 2*time.Second {
+		t.Errorf("no backoff without max backoff: %v", d)
+	}
+	if d := w.Backoff(100); d > DefaultMaxBackoffFactor*time.Second {
+		t.Errorf("delay exceeds default max backoff: %v", d)
+	}
+}
+
+func TestMaxBackoffBelowInterval(t *testing.T) {
+	w := &Watcher {
+		Interval: time.Hour,
+		MaxBackoff: 15*time.Minute,
+	}
+
+	for failures := 1; failures < 10; failures++ {
+		if d := w.Backoff(failures); d < w.Interval {
+			t.Errorf("delay below interval: %v", d)
+		}
+	}
+}
+
+func TestRunWritesStatus(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := &Watcher {
+		Source: "foo",
+		Interval: time.Millisecond,
+		MaxBackoff: time.Millisecond,
+		StatusPath: filepath.Join(t.TempDir(), "status.json"),
+	}
+
+	polls := 0
+	poll := func(ctx context.Context) (string, bool, error) {
+		polls += 1
+		switch polls {
+		case 1:
+			return "abc", true, nil
+		case 2:
+			return "abc", false, nil
+		case 3:
+			cancel()
+			return "abc", false, errors.New("bar")
+		}
+		t.Fatalf("polled after cancel")
+		return "", false, nil
+	}
+
+	if err := w.Run(ctx, poll); !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	bs, err := os.ReadFile(w.StatusPath)
+	if err != nil {
+		t.Fatalf("unable to read status: %v", err)
+	}
+
+	var s Status
+	if err := json.Unmarshal(bs, &s); err != nil {
+		t.Fatalf("unable to parse status: %v", err)
+	}
+
+	if s.Source != "foo" || s.SHA256 != "abc" || s.Applied == nil || s.Error != "bar" || s.Failures != 1 {
+		t.Errorf("unexpected status: %+v", s)
+	}
+}
@@ -12,13 +12,25 @@ import (
 	"compress/gzip"
 	"strconv"
 	"fmt"
+	"errors"
+	"encoding/hex"
+	"crypto/sha256"
+	"path"
+	"time"
+	"os/signal"
+	"syscall"
 
 	"rootmos.io/go-utils/hashed"
 	"rootmos.io/go-utils/logging"
-	"rootmos.io/go-utils/osext"
 	"rootmos.io/go-utils/sealedbox"
 
+	"rootmos.io/sitepkg/internal/cas"
 	"rootmos.io/sitepkg/internal/common"
+	"rootmos.io/sitepkg/internal/keyprovider"
+	"rootmos.io/sitepkg/internal/rollback"
+	"rootmos.io/sitepkg/internal/storage"
+	"rootmos.io/sitepkg/internal/versions"
+	"rootmos.io/sitepkg/internal/watch"
 	"rootmos.io/sitepkg/manifest"
 )
 
@@ -29,19 +41,72 @@ type state struct {
 	key *sealedbox.Key
 	gzipLevel int
 	tarballNotExistOk bool
+	expectSHA256 []byte
+	snapshot string
+	versioned bool
+	bases []string
+	rollbackDir string
+	sealRollback bool
+
+	// SHA256 of the tarball currently applied (or published), set when watching
+	current []byte
+	applied bool
+}
+
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
 }
 
 func (st *state) create(ctx context.Context) error {
 	logger := logging.Get(ctx)
 
+	if cas.IsRepository(st.tarball) {
+		_, err := cas.Open(st.tarball, st.key).Create(ctx, st.m)
+		return err
+	}
+
+	bases, err := st.fetchBases(ctx)
+	if err != nil {
+		return err
+	}
+
+	var base manifest.Index
+	if len(bases) > 0 {
+		base = make(manifest.Index)
+		for _, r := range bases {
+			if err := base.Update(r); err != nil {
+				return fmt.Errorf("unable to index base: %v", err)
+			}
+		}
+	}
+
 	var buf bytes.Buffer
-	if err := st.m.Create(ctx, &buf); err != nil {
+	if err := st.m.CreateIncremental(ctx, &buf, base); err != nil {
 		return err
 	}
 
+	// compare the entries of the plain tarball, since sealing is not
+	// deterministic and the tarball records times unless reproducible
+	entriesDgst, err := manifest.Digest(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return err
+	}
+	if st.current != nil && bytes.Equal(entriesDgst, st.current) {
+		logger.Info("unchanged; skipping", "SHA256", hex.EncodeToString(st.current))
+		return nil
+	}
+
 	r := io.Reader(&buf)
 	if st.gzipLevel != gzip.NoCompression {
 		var cmp bytes.Buffer
+		// the gzip header is left without timestamp and name, keeping reproducible tarballs reproducible when compressed
 		w, err := gzip.NewWriterLevel(&cmp, st.gzipLevel)
 		if err != nil {
 			return fmt.Errorf("unable to initialize gzip: %s", err)
@@ -81,47 +146,245 @@ func (st *state) create(ctx context.Context) error {
 	}
 
 	rh := hashed.ReaderSHA256(r)
+	bs, err := io.ReadAll(rh)
+	if err != nil {
+		return fmt.Errorf("unable to read tarball: %v", err)
+	}
+	dgst, err := hex.DecodeString(rh.HexDigest())
+	if err != nil {
+		return err
+	}
+
+	url := st.tarball
+	if st.versioned {
+		url = versions.URL(st.tarball, versions.Name(time.Now(), dgst, st.suffix()))
+		if err := storage.MkdirAll(url); err != nil {
+			return err
+		}
+	}
 
-	if err := osext.Create(ctx, st.tarball, rh); err != nil {
+	if err := storage.Create(ctx, url, storage.NewObject(bytes.NewReader(bs), dgst)); err != nil {
 		return fmt.Errorf("unable to write tarball: %v", err)
 	}
 
+	if st.versioned {
+		_, name := path.Split(url)
+		if err := versions.SetLatest(ctx, st.tarball, name); err != nil {
+			return fmt.Errorf("unable to update latest version: %v", err)
+		}
+		logger.Info("created version", "version", name)
+	}
+
 	logger.Info("created", "SHA256", rh.HexDigest())
 
+	st.current = entriesDgst
+	st.applied = true
+
 	return nil
 }
 
+// watchCreate republishes the package whenever the files covered by the
+// manifest change, until SIGTERM/SIGINT is received
+func (st *state) watchCreate(ctx context.Context, debounce time.Duration) error {
+	logger := logging.Get(ctx)
+
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	for {
+		if err := st.create(ctx); err != nil {
+			logger.Warn("unable to create tarball", "err", err)
+		}
+
+		paths, err := st.watchPaths(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = watch.Wait(ctx, paths, debounce)
+		if ctx.Err() != nil {
+			logger.Info("stopping")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// watchPaths lists the existing directories and files covered by the
+// manifest, together with the directories in which they may appear
+func (st *state) watchPaths(ctx context.Context) (paths []string, err error) {
+	seen := make(map[string]bool)
+	add := func(path string) {
+		if seen[path] {
+			return
+		}
+		seen[path] = true
+		if _, err := os.Stat(path); err == nil {
+			paths = append(paths, path)
+		}
+	}
+
+	for _, p := range st.m.Paths {
+		names, err := st.m.Expand(ctx, p)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		add(filepath.Dir(st.m.Resolve(ctx, strings.TrimSuffix(p, "/**"))))
+		for _, n := range names {
+			path := st.m.Resolve(ctx, n)
+			if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+				add(path)
+			}
+			add(filepath.Dir(path))
+		}
+	}
+
+	return paths, nil
+}
+
 func (st *state) extract(ctx context.Context) error {
+	if st.rollbackDir == "" {
+		return st.extractPackage(ctx)
+	}
+
+	var undo bytes.Buffer
+	st.m.Undo = &undo
+
+	// saved also when the extraction failed part way through
+	err := st.extractPackage(ctx)
+	if undo.Len() == 0 {
+		return err
+	}
+
+	var key *sealedbox.Key
+	if st.sealRollback {
+		key = st.key
+	}
+
+	if _, e := rollback.Save(ctx, st.rollbackDir, undo.Bytes(), key); e != nil {
+		if err != nil {
+			return fmt.Errorf("unable to save rollback archive (%v) after: %v", e, err)
+		}
+		return fmt.Errorf("unable to save rollback archive: %v", e)
+	}
+
+	return err
+}
+
+func (st *state) extractPackage(ctx context.Context) error {
 	logger := logging.Get(ctx)
 
+	if cas.IsRepository(st.tarball) {
+		return cas.Open(st.tarball, st.key).Extract(ctx, st.m, st.snapshot)
+	}
+
 	logger.Info("extracting")
-	f, err := osext.Open(ctx, st.tarball)
-	if osext.IsNotExist(err) && st.tarballNotExistOk {
+	f, err := storage.Open(ctx, st.tarball)
+	if storage.IsNotExist(err) && st.tarballNotExistOk {
 		logger.Info("failing gracefully: tarball does not exist", "tarball", st.tarball)
 		return nil
 	}
+	var nme *storage.NotModifiedError
+	if errors.As(err, &nme) {
+		if st.expectSHA256 != nil && !bytes.Equal(st.expectSHA256, nme.SHA256) {
+			return fmt.Errorf("SHA256 mismatch: %x != %x (expected)", nme.SHA256, st.expectSHA256)
+		}
+		logger.Info("not modified; skipping", "SHA256", hex.EncodeToString(nme.SHA256))
+		st.current = nme.SHA256
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("unable to open tarball: %v", err)
 	}
 	defer f.Close()
 
+	if sha := storage.ExpectedSHA256(f); st.current != nil && bytes.Equal(sha, st.current) {
+		logger.Info("unchanged; skipping", "SHA256", hex.EncodeToString(sha))
+		return nil
+	}
+
 	rh := hashed.ReaderSHA256(f)
 	r := io.Reader(rh)
 
+	expected := st.expectSHA256
+	if expected == nil {
+		expected = storage.ExpectedSHA256(f)
+	}
+	if expected != nil || st.current != nil {
+		bs, err := io.ReadAll(rh)
+		if err != nil {
+			return fmt.Errorf("unable to read tarball: %s", err)
+		}
+
+		if expected != nil {
+			if actual := rh.HexDigest(); actual != hex.EncodeToString(expected) {
+				return fmt.Errorf("SHA256 mismatch: %s != %x (expected)", actual, expected)
+			}
+			logger.Debug("verified SHA256", "SHA256", rh.HexDigest())
+		}
+
+		if actual := rh.HexDigest(); actual == hex.EncodeToString(st.current) {
+			logger.Info("unchanged; skipping", "SHA256", actual)
+			return nil
+		}
+
+		r = bytes.NewReader(bs)
+	}
+
+	r, err = st.decode(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	bases, err := st.fetchBases(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := st.m.ExtractChain(ctx, append(bases, r)...); err != nil {
+		return fmt.Errorf("unable to extract tarball: %s", err)
+	}
+
+	// drain any trailing bytes (e.g. tar padding) so that the digest covers everything
+	if _, err := io.Copy(io.Discard, rh); err != nil {
+		return fmt.Errorf("unable to read tarball: %s", err)
+	}
+
+	dgst, err := hex.DecodeString(rh.HexDigest())
+	if err != nil {
+		return err
+	}
+	if err := storage.Commit(f, dgst); err != nil {
+		return fmt.Errorf("unable to commit tarball: %s", err)
+	}
+	st.current = dgst
+	st.applied = true
+
+	logger.Info("extracted", "SHA256", rh.HexDigest())
+	return nil
+}
+
+// decode decrypts and decompresses a package
+func (st *state) decode(ctx context.Context, r io.Reader) (io.Reader, error) {
+	logger := logging.Get(ctx)
+
 	if st.key != nil {
 		bs, err := io.ReadAll(r)
 		if err != nil {
-			return fmt.Errorf("unable to read tarball: %s", err)
+			return nil, fmt.Errorf("unable to read tarball: %s", err)
 		}
 
 		var box sealedbox.Box
 		if err := box.UnmarshalBinary(bs); err != nil {
-			return fmt.Errorf("unable to unmarshal box: %s", err)
+			return nil, fmt.Errorf("unable to unmarshal box: %s", err)
 		}
 
 		pt, err := box.Open(st.key)
 		if err != nil {
-			return fmt.Errorf("unable to decrypt box: %s", err)
+			return nil, fmt.Errorf("unable to decrypt box: %s", err)
 		}
 
 		logger.Debug("decrypted")
@@ -132,21 +395,66 @@ func (st *state) extract(ctx context.Context) error {
 	if st.gzipLevel != gzip.NoCompression {
 		g, err := gzip.NewReader(r)
 		if err != nil {
-			return fmt.Errorf("unable to initialize gzip: %s", err)
+			return nil, fmt.Errorf("unable to initialize gzip: %s", err)
 		}
-		defer g.Close()
 		r = g
 	}
 
-	if err := st.m.Extract(ctx, r); err != nil {
-		return fmt.Errorf("unable to extract tarball: %s", err)
+	return r, nil
+}
+
+// fetchBases fetches and decodes the chain of base packages of an incremental package
+func (st *state) fetchBases(ctx context.Context) (rs []io.Reader, err error) {
+	for _, url := range st.bases {
+		logger, ctx := logging.WithAttrs(ctx, "base", url)
+		logger.Info("fetching base")
+
+		f, err := storage.Open(ctx, url)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open base: %s: %v", url, err)
+		}
+
+		rh := hashed.ReaderSHA256(f)
+		bs, err := io.ReadAll(rh)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read base: %s: %v", url, err)
+		}
+
+		if expected := storage.ExpectedSHA256(f); expected != nil && rh.HexDigest() != hex.EncodeToString(expected) {
+			return nil, fmt.Errorf("SHA256 mismatch: %s: %s != %x (expected)", url, rh.HexDigest(), expected)
+		}
+
+		r, err := st.decode(ctx, bytes.NewReader(bs))
+		if err != nil {
+			return nil, err
+		}
+
+		tarball, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode base: %s: %v", url, err)
+		}
+
+		logger.Debug("fetched base", "SHA256", rh.HexDigest())
+		rs = append(rs, bytes.NewReader(tarball))
 	}
 
-	logger.Info("extracted", "SHA256", rh.HexDigest())
-	return nil
+	return
+}
+
+func (st *state) suffix() string {
+	s := ".tar"
+	if st.gzipLevel != gzip.NoCompression {
+		s += ".gz"
+	}
+	if st.key != nil {
+		s += ".enc"
+	}
+	return s
 }
 
 func filenameSuggestCompression(path string) bool {
+	path, _, _ = strings.Cut(path, "?")
 	return (strings.HasSuffix(path, ".gz") ||
 		strings.HasSuffix(path, ".gz.enc") ||
 		strings.HasSuffix(path, ".tgz") ||
@@ -155,17 +463,88 @@ func filenameSuggestCompression(path string) bool {
 
 func main() {
 	chrootFlag := flag.String("chroot", common.Getenv("CHROOT"), "act relative directory")
-	manifestFlag := flag.String("manifest", common.Getenv("MANIFEST"), "manifest path")
+	manifestFlag := flag.String("manifest", common.Getenv("MANIFEST"), "manifest path (line-oriented, or a structured .json, .yaml or .toml document)")
 
 	createFlag := flag.String("create", common.Getenv("CREATE"), "write tarball")
 	extractFlag := flag.String("extract", common.Getenv("EXTRACT"), "extract tarball")
+	snapshotFlag := flag.String("snapshot", common.Getenv("SNAPSHOT"), "snapshot to extract from a content-addressed repository (" + cas.Prefix + "URL), defaults to the latest")
+	versionedFlag := flag.Bool("versioned", common.GetenvBool("VERSIONED"), "treat the create/extract argument as a prefix of versioned packages")
+	versionFlag := flag.String("version", common.Getenv("VERSION"), "version to extract (when versioned), defaults to the latest")
+	actionFlag := flag.String("action", common.Getenv("ACTION"), "create or extract the destination of a structured manifest")
+	explainFlag := flag.Bool("explain", common.GetenvBool("EXPLAIN"), "list the paths and excludes of the manifest and the files (and lines) contributing them")
+	pruneFlag := flag.String("prune", common.Getenv("PRUNE"), "prune versioned packages below prefix")
+	keepLatestFlag := flag.Int("keep-latest", common.GetenvInt("KEEP_LATEST", 0), "when pruning, keep the latest N versions")
+	keepDailyFlag := flag.Int("keep-daily", common.GetenvInt("KEEP_DAILY", 0), "when pruning, keep the latest version of the latest N days")
+	keepWeeklyFlag := flag.Int("keep-weekly", common.GetenvInt("KEEP_WEEKLY", 0), "when pruning, keep the latest version of the latest N weeks")
+	dryRunFlag := flag.Bool("dry-run", common.GetenvBool("DRY_RUN"), "only report what would be pruned")
+	var basesFlag stringsFlag
+	if b := common.Getenv("BASE"); b != "" {
+		basesFlag = strings.Split(b, ",")
+	}
+	flag.Var(&basesFlag, "base", "base package(s), oldest first, of an incremental package (may be repeated; expected to share compression and key)")
 	// verifyFlag := flag.String("verify", common.Getenv("VERIFY"), "verify tarball") // or status? check? test?
 
 	ignoreMissingFlag := flag.Bool("ignore-missing", common.GetenvBool("IGNORE_MISSING"), "ignore missing files")
+	syncFlag := flag.Bool("sync", common.GetenvBool("SYNC"), "remove files below recursive and glob manifest paths not present in the tarball")
+	noXattrsFlag := flag.Bool("no-xattrs", common.GetenvBool("NO_XATTRS"), "don't capture or restore extended attributes")
+	var xattrsIncludeFlag, xattrsExcludeFlag stringsFlag
+	if x := common.Getenv("XATTRS_INCLUDE"); x != "" {
+		xattrsIncludeFlag = strings.Split(x, ",")
+	}
+	if x := common.Getenv("XATTRS_EXCLUDE"); x != "" {
+		xattrsExcludeFlag = strings.Split(x, ",")
+	}
+	flag.Var(&xattrsIncludeFlag, "xattrs-include", "extended attributes to capture and restore (may be repeated; patterns like user.*), defaults to: " + strings.Join(manifest.DefaultXattrIncludes, ", "))
+	flag.Var(&xattrsExcludeFlag, "xattrs-exclude", "extended attributes to skip (may be repeated; patterns like user.*)")
+	var varFlag stringsFlag
+	flag.Var(&varFlag, "var", "variable expanded in the manifest and available to templates: k=v (may be repeated; takes precedence over the environment)")
+	expandVarsFlag := flag.Bool("expand-vars", common.GetenvBool("EXPAND_VARS"), "expand variables (from the environment and -var) in the manifest, implied by -var and -strict-vars")
+	strictVarsFlag := flag.Bool("strict-vars", common.GetenvBool("STRICT_VARS"), "fail on undefined variables in the manifest")
+	var ownerMapFlag, groupMapFlag stringsFlag
+	if x := common.Getenv("OWNER_MAP"); x != "" {
+		ownerMapFlag = append(ownerMapFlag, x)
+	}
+	if x := common.Getenv("GROUP_MAP"); x != "" {
+		groupMapFlag = append(groupMapFlag, x)
+	}
+	flag.Var(&ownerMapFlag, "owner-map", "map owners when extracting: from:to[,from:to...] (names or ids) or @file with one from:to per line (may be repeated)")
+	flag.Var(&groupMapFlag, "group-map", "map groups when extracting: from:to[,from:to...] (names or ids) or @file with one from:to per line (may be repeated)")
+	numericOwnerFlag := flag.Bool("numeric-owner", common.GetenvBool("NUMERIC_OWNER"), "ignore user and group names when extracting")
+	noSameOwnerFlag := flag.Bool("no-same-owner", common.GetenvBool("NO_SAME_OWNER"), "leave extracted files owned by the extracting user")
+	specialFilesFlag := flag.String("special-files", common.Getenv("SPECIAL_FILES"), "how to handle device nodes, FIFOs and sockets: include (default; skipping sockets), skip or error")
+	symlinksFlag := flag.Bool("symlinks", common.GetenvBool("SYMLINKS"), "store symlinks as such instead of the content of their targets when creating")
+	accessTimesFlag := flag.Bool("access-times", common.GetenvBool("ACCESS_TIMES"), "record access times (and sub-second modification times) when creating")
+	noTimesFlag := flag.Bool("no-times", common.GetenvBool("NO_TIMES"), "don't restore access and modification times when extracting")
+	noDirTimesFlag := flag.Bool("no-dir-times", common.GetenvBool("NO_DIR_TIMES"), "don't restore the times of directories when extracting")
+	backupDirFlag := flag.String("backup-dir", common.Getenv("BACKUP_DIR"), "move files removed when syncing to this directory")
+	rollbackDirFlag := flag.String("rollback-dir", common.Getenv("ROLLBACK_DIR"), "save the previous state of files modified by extractions here")
+	sealRollbackFlag := flag.Bool("seal-rollback", common.GetenvBool("SEAL_ROLLBACK"), "seal rollback archives using the key")
+	rollbackFlag := flag.Int("rollback", common.GetenvInt("ROLLBACK", 0), "roll back the N latest extractions")
+	watchFlag := flag.Bool("watch", common.GetenvBool("WATCH"), "keep polling the extract source and apply it when changed (use -http-state-dir to poll HTTP(S) sources using ETag/Last-Modified), or republish the created package when the files change")
+	watchDebounceFlag := flag.Duration("watch-debounce", common.GetenvDuration("WATCH_DEBOUNCE", 2*time.Second), "when creating, wait for the files to stay unchanged this long before republishing")
+	watchIntervalFlag := flag.Duration("watch-interval", common.GetenvDuration("WATCH_INTERVAL", time.Minute), "interval between polls when watching")
+	watchMaxBackoffFlag := flag.Duration("watch-max-backoff", common.GetenvDuration("WATCH_MAX_BACKOFF", 0), "maximum delay between failed polls when watching (0: 16 times the interval)")
+	statusFileFlag := flag.String("status-file", common.Getenv("STATUS_FILE"), "write the last applied state as JSON here when watching")
 	tarballNotExistOkFlag := flag.Bool("tarball-not-exist-ok", common.GetenvBool("NOT_EXIST_OK"), "fail gracefully if tarball does not exist")
 
+	ssmKmsKeyIdFlag := flag.String("ssm-kms-key-id", common.Getenv("SSM_KMS_KEY_ID"), "KMS key used to encrypt packages stored as SSM parameters (ssm:///path/to/parameter)")
+
+	s3ContentTypeFlag := flag.String("s3-content-type", common.Getenv("S3_CONTENT_TYPE"), "content-type of packages uploaded to S3")
+	s3SSEKMSKeyIdFlag := flag.String("s3-sse-kms-key-id", common.Getenv("S3_SSE_KMS_KEY_ID"), "encrypt packages uploaded to S3 using SSE-KMS with the specified key")
+	s3StorageClassFlag := flag.String("s3-storage-class", common.Getenv("S3_STORAGE_CLASS"), "storage class of packages uploaded to S3")
+	s3TaggingFlag := flag.String("s3-tagging", common.Getenv("S3_TAGGING"), "tags of packages uploaded to S3 (e.g. foo=bar&baz=qux)")
+	s3CreateOnlyFlag := flag.Bool("s3-create-only", common.GetenvBool("S3_CREATE_ONLY"), "refuse to overwrite existing packages in S3")
+
+	httpStateDirFlag := flag.String("http-state-dir", common.Getenv("HTTP_STATE_DIR"), "remember ETag/Last-Modified of extracted HTTP(S) packages and skip unchanged ones")
+	httpRetriesFlag := flag.Int("http-retries", common.GetenvInt("HTTP_RETRIES", 3), "retry and resume HTTP(S) downloads")
+	expectSHA256Flag := flag.String("expect-sha256", common.Getenv("EXPECT_SHA256"), "abort extraction unless the package has the specified SHA256")
+
+	reproducibleFlag := flag.Bool("reproducible", common.GetenvBool("REPRODUCIBLE"), "create byte-identical tarballs for identical content (mtimes set to SOURCE_DATE_EPOCH or zero)")
+	normalizeOwnerFlag := flag.Bool("normalize-owner", common.GetenvBool("NORMALIZE_OWNER"), "when reproducible, record all entries as owned by root")
+
 	gzipFlag := flag.String("gzip", common.Getenv("GZIP"), "compress using gzip level")
 
+	keyFlag := flag.String("key", common.Getenv("KEY"), "encrypt/decrypt using the key specified by URL (" + strings.Join(keyprovider.Schemes(), ", ") + ")")
 	keyfileFlag := flag.String("keyfile", common.Getenv("KEYFILE"), "encrypt/decrypt using the specified keyfile")
 	awsSecretsmanagerSecretArnFlag := flag.String(
 		"aws-secretsmanager-secret-arn",
@@ -186,8 +565,29 @@ func main() {
 
 	ctx := logging.Set(context.Background(), logger)
 
+	storage.DefaultSSM.KeyId = *ssmKmsKeyIdFlag
+	storage.DefaultS3.ContentType = *s3ContentTypeFlag
+	storage.DefaultS3.SSEKMSKeyId = *s3SSEKMSKeyIdFlag
+	storage.DefaultS3.StorageClass = *s3StorageClassFlag
+	storage.DefaultS3.Tagging = *s3TaggingFlag
+	storage.DefaultS3.CreateOnly = *s3CreateOnlyFlag
+	storage.DefaultHTTP.StateDir = *httpStateDirFlag
+	storage.DefaultHTTP.Retries = *httpRetriesFlag
+
 	st := state {
 		tarballNotExistOk: *tarballNotExistOkFlag,
+		snapshot: *snapshotFlag,
+		versioned: *versionedFlag,
+		bases: basesFlag,
+		rollbackDir: *rollbackDirFlag,
+		sealRollback: *sealRollbackFlag,
+	}
+
+	if *expectSHA256Flag != "" {
+		st.expectSHA256, err = hex.DecodeString(*expectSHA256Flag)
+		if err != nil || len(st.expectSHA256) != sha256.Size {
+			logger.ExitfContext(ctx, 2, "unable to parse SHA256: %s", *expectSHA256Flag)
+		}
 	}
 
 	root := *chrootFlag
@@ -205,16 +605,79 @@ func main() {
 		logger.Info("root", "path", root)
 	}
 
+	var vars *manifest.Vars
+	if *expandVarsFlag || *strictVarsFlag || len(varFlag) > 0 {
+		vars = &manifest.Vars{ Strict: *strictVarsFlag }
+	}
+	for _, v := range varFlag {
+		if err := vars.Parse(v); err != nil {
+			logger.With("err", err).ExitfContext(ctx, 2, "unable to parse variable: %s", v)
+		}
+	}
+
 	if *manifestFlag == "" {
-		st.m = &manifest.Manifest{}
+		// available to the templates of the package
+		st.m = &manifest.Manifest{ Vars: vars }
 	} else {
 		path := *manifestFlag
-		st.m, err = manifest.Load(ctx, path, root)
+		st.m, err = manifest.LoadVars(ctx, path, root, vars)
 		if err != nil {
 			logger.With("err", err).ExitfContext(ctx, 1, "unable to load manifest: %s", path)
 		}
+		if *chrootFlag != "" {
+			st.m.Root = root
+		} else if st.m.Root != root {
+			root = st.m.Root
+			logger.Info("root", "path", root)
+		}
 	}
 	st.m.IgnoreMissing = *ignoreMissingFlag
+	st.m.Sync = *syncFlag
+	st.m.BackupDir = *backupDirFlag
+	if !*noXattrsFlag {
+		st.m.Xattrs = &manifest.Xattrs {
+			Include: xattrsIncludeFlag,
+			Exclude: xattrsExcludeFlag,
+		}
+		if len(st.m.Xattrs.Include) == 0 {
+			st.m.Xattrs.Include = manifest.DefaultXattrIncludes
+		}
+	}
+	st.m.OwnerMap, st.m.GroupMap = make(manifest.IdMap), make(manifest.IdMap)
+	for _, x := range ownerMapFlag {
+		if err := st.m.OwnerMap.Parse(x); err != nil {
+			logger.With("err", err).ExitfContext(ctx, 2, "unable to parse owner map: %s", x)
+		}
+	}
+	for _, x := range groupMapFlag {
+		if err := st.m.GroupMap.Parse(x); err != nil {
+			logger.With("err", err).ExitfContext(ctx, 2, "unable to parse group map: %s", x)
+		}
+	}
+	st.m.NumericOwner = *numericOwnerFlag
+	st.m.NoSameOwner = *noSameOwnerFlag
+	st.m.Special, err = manifest.ParseSpecialPolicy(*specialFilesFlag)
+	if err != nil {
+		logger.With("err", err).ExitfContext(ctx, 2, "unable to parse special files policy: %s", *specialFilesFlag)
+	}
+	st.m.Symlinks = *symlinksFlag
+	st.m.AccessTimes = *accessTimesFlag
+	st.m.NoTimes = *noTimesFlag
+	st.m.NoDirTimes = *noDirTimesFlag
+
+	if *reproducibleFlag {
+		st.m.Reproducible = &manifest.Reproducible {
+			ModTime: time.Unix(0, 0),
+			NormalizeOwner: *normalizeOwnerFlag,
+		}
+		if e := os.Getenv("SOURCE_DATE_EPOCH"); e != "" {
+			secs, err := strconv.ParseInt(e, 10, 64)
+			if err != nil {
+				logger.With("err", err).ExitfContext(ctx, 2, "unable to parse SOURCE_DATE_EPOCH: %s", e)
+			}
+			st.m.Reproducible.ModTime = time.Unix(secs, 0)
+		}
+	}
 
 	for _, p := range flag.Args() {
 		st.m.Add(p)
@@ -224,6 +687,9 @@ func main() {
 		ActionNoop = iota
 		ActionCreate
 		ActionExtract
+		ActionPrune
+		ActionRollback
+		ActionExplain
 	)
 	action := ActionNoop
 
@@ -241,11 +707,72 @@ func main() {
 		action = ActionExtract
 		st.tarball = *extractFlag
 	}
+	if *actionFlag != "" {
+		if action != ActionNoop {
+			logger.ExitContext(ctx, 2, "more than one action specified")
+		}
+		if st.m.Package == nil || st.m.Package.Destination == "" {
+			logger.ExitContext(ctx, 2, "action without the destination of a structured manifest")
+		}
+		switch *actionFlag {
+		case "create":
+			action = ActionCreate
+		case "extract":
+			action = ActionExtract
+		default:
+			logger.ExitfContext(ctx, 2, "unsupported action: %s", *actionFlag)
+		}
+		st.tarball = st.m.Package.Destination
+	}
+	if *pruneFlag != "" {
+		if action != ActionNoop {
+			logger.ExitContext(ctx, 2, "more than one action specified")
+		}
+		action = ActionPrune
+		st.tarball = *pruneFlag
+	}
+
+	if *rollbackFlag > 0 {
+		if action != ActionNoop {
+			logger.ExitContext(ctx, 2, "more than one action specified")
+		}
+		if st.rollbackDir == "" {
+			logger.ExitContext(ctx, 2, "rollback without rollback directory")
+		}
+		action = ActionRollback
+	}
+
+	if *explainFlag {
+		if action != ActionNoop {
+			logger.ExitContext(ctx, 2, "more than one action specified")
+		}
+		action = ActionExplain
+	}
+
+	if *watchFlag && action != ActionExtract && action != ActionCreate {
+		logger.ExitContext(ctx, 2, "watch without create or extract")
+	}
+	if *watchFlag && *watchIntervalFlag <= 0 {
+		logger.ExitfContext(ctx, 2, "non-positive watch interval: %v", *watchIntervalFlag)
+	}
+
+	source := st.tarball
+	var prefix string
+	if action == ActionExtract && st.versioned {
+		prefix = st.tarball
+		st.tarball, err = versions.Resolve(ctx, prefix, *versionFlag)
+		if err != nil {
+			logger.With("err", err).ExitfContext(ctx, 1, "unable to resolve version: %s", prefix)
+		}
+		st.versioned = false
+	}
 
 	logger, ctx = logging.WithAttrs(ctx, "tarball", st.tarball)
 
 	st.gzipLevel = gzip.NoCompression
-	if *gzipFlag != "" {
+	if *gzipFlag == "" && st.m.Package != nil && st.m.Package.Gzip != nil {
+		st.gzipLevel = *st.m.Package.Gzip
+	} else if *gzipFlag != "" {
 		st.gzipLevel, err = strconv.Atoi(*gzipFlag)
 		if err != nil {
 			logger.With("err", err).ExitfContext(ctx, 2, "unable to parse as integer: %s", *gzipFlag)
@@ -254,40 +781,89 @@ func main() {
 		st.gzipLevel = gzip.DefaultCompression
 	}
 
-	if *keyfileFlag != "" || *awsSecretsmanagerSecretArnFlag != "" {
-		if *keyfileFlag != "" && *awsSecretsmanagerSecretArnFlag != "" {
-			logger.ExitContext(ctx, 2, "both keyfile and AWS Secrets Manager Secret specified")
-		}
+	var keyURLs []string
+	if *keyFlag != "" {
+		keyURLs = append(keyURLs, *keyFlag)
+	}
+	if *keyfileFlag != "" {
+		keyURLs = append(keyURLs, "file://" + *keyfileFlag)
+	}
+	if *awsSecretsmanagerSecretArnFlag != "" {
+		keyURLs = append(keyURLs, "awssm://" + *awsSecretsmanagerSecretArnFlag)
+	}
+	if len(keyURLs) == 0 && st.m.Package != nil && st.m.Package.Key != "" {
+		keyURLs = append(keyURLs, st.m.Package.Key)
+	}
 
-		if *keyfileFlag != "" {
-			path := *keyfileFlag
-			logger.Info("using keyfile", "keyfile", path)
-			st.key, err = sealedbox.LoadKeyfile(path)
-			if err != nil {
-				logger.With("err", err).ExitfContext(ctx, 1, "unable to load keyfile: %s", path)
-			}
-			defer st.key.Close()
-		}
+	keyring := keyprovider.NewKeyring()
+	defer keyring.Close()
 
-		if *awsSecretsmanagerSecretArnFlag != "" {
-			arn := *awsSecretsmanagerSecretArnFlag
-			st.key, err = getKeyFromSMSecretValue(ctx, arn)
-			if err != nil {
-				logger.With("err", err).ExitfContext(ctx, 1, "unable to get key from Secrets Manager: %s", arn)
-			}
-			defer st.key.Close()
+	switch len(keyURLs) {
+	case 0:
+	case 1:
+		url := keyURLs[0]
+		st.key, err = keyring.Get(ctx, url)
+		if err != nil {
+			logger.With("err", err).ExitfContext(ctx, 1, "unable to get key: %s", url)
 		}
+	default:
+		logger.ExitContext(ctx, 2, "more than one key specified")
 	}
 
 	switch action {
 	case ActionCreate:
+		if *watchFlag {
+			if err := st.watchCreate(ctx, *watchDebounceFlag); err != nil {
+				logger.Exit(1, "unable to watch: %v", err)
+			}
+			break
+		}
 		if err := st.create(ctx); err != nil {
 			logger.Exit(1, "unable to create tarball: %v", err)
 		}
 	case ActionExtract:
+		if *watchFlag {
+			w := watch.Watcher {
+				Source: source,
+				Interval: *watchIntervalFlag,
+				MaxBackoff: *watchMaxBackoffFlag,
+				StatusPath: *statusFileFlag,
+			}
+			poll := func(ctx context.Context) (string, bool, error) {
+				if prefix != "" {
+					if st.tarball, err = versions.Resolve(ctx, prefix, *versionFlag); err != nil {
+						return hex.EncodeToString(st.current), false, fmt.Errorf("unable to resolve version: %v", err)
+					}
+				}
+				st.applied = false
+				err := st.extract(ctx)
+				return hex.EncodeToString(st.current), st.applied, err
+			}
+			if err := w.Run(ctx, poll); err != nil {
+				logger.Exit(1, "unable to watch: %v", err)
+			}
+			break
+		}
 		if err := st.extract(ctx); err != nil {
 			logger.Exit(1, "unable to extract tarball: %v", err)
 		}
+	case ActionPrune:
+		policy := versions.Policy {
+			Latest: *keepLatestFlag,
+			Daily: *keepDailyFlag,
+			Weekly: *keepWeeklyFlag,
+		}
+		if err := versions.Prune(ctx, st.tarball, policy, *dryRunFlag); err != nil {
+			logger.Exit(1, "unable to prune: %v", err)
+		}
+	case ActionRollback:
+		if err := rollback.Restore(ctx, st.rollbackDir, root, *rollbackFlag, st.key); err != nil {
+			logger.Exit(1, "unable to roll back: %v", err)
+		}
+	case ActionExplain:
+		if err := st.m.Explain(os.Stdout); err != nil {
+			logger.Exit(1, "unable to explain manifest: %v", err)
+		}
 	case ActionNoop:
 		logger.Info("noop")
 	}
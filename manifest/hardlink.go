@@ -0,0 +1,65 @@
+package manifest
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"archive/tar"
+	"fmt"
+
+	"rootmos.io/go-utils/logging"
+)
+
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// hardlinks tracks the first name of files having several links by inode
+type hardlinks map[inode]string
+
+// seen returns the name first seen for the file, or records the name
+func (h hardlinks) seen(fi os.FileInfo, name string) (string, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || !fi.Mode().IsRegular() || st.Nlink < 2 {
+		return "", false
+	}
+
+	i := inode{ dev: uint64(st.Dev), ino: uint64(st.Ino) }
+	if first, ok := h[i]; ok {
+		return first, true
+	}
+	h[i] = name
+	return "", false
+}
+
+// link recreates a hard link to an entry previously extracted
+func (m *Manifest) link(ctx context.Context, path string, hdr *tar.Header, extracted, changed map[string]bool) error {
+	if !extracted[hdr.Linkname] {
+		return fmt.Errorf("hard link target not extracted: %s -> %s", hdr.Name, hdr.Linkname)
+	}
+	target := m.Resolve(ctx, hdr.Linkname)
+
+	if fi, err := os.Lstat(path); err == nil {
+		tfi, err := os.Lstat(target)
+		if err != nil {
+			return err
+		}
+		if os.SameFile(fi, tfi) {
+			// changed along with the target
+			changed[hdr.Name] = changed[hdr.Linkname]
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Link(target, path); err != nil {
+		return err
+	}
+	changed[hdr.Name] = true
+
+	logging.Get(ctx).InfoContext(ctx, "extracted hard link", "name", hdr.Name, "target", hdr.Linkname)
+	return nil
+}
@@ -0,0 +1,155 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"rootmos.io/go-utils/hashed"
+	"rootmos.io/go-utils/logging"
+)
+
+type HookPhase string
+
+const (
+	// before extracting
+	HookPre HookPhase = "pre"
+	// after extracting, rolling back the extraction when failing
+	HookValidate HookPhase = "validate"
+	// after extracting (and validating)
+	HookPost HookPhase = "post"
+)
+
+// A Hook runs a shell command relative to the root. Validate and post hooks
+// run only when a path matching their pattern changed, and receive the
+// changed names (newline separated) in SITEPKG_CHANGED.
+type Hook struct {
+	Phase HookPhase
+	Pattern string
+	// additional patterns, any of which triggers the hook
+	Patterns []string
+	Command string
+}
+
+// ParseHook parses "pre <command>" or "validate|post <pattern> <command>"
+func ParseHook(s string) (h Hook, err error) {
+	phase, rest, _ := strings.Cut(strings.TrimSpace(s), " ")
+	h.Phase = HookPhase(phase)
+
+	switch h.Phase {
+	case HookPre:
+	case HookValidate, HookPost:
+		h.Pattern, rest, _ = strings.Cut(strings.TrimSpace(rest), " ")
+	default:
+		return h, fmt.Errorf("unsupported hook phase: %s", phase)
+	}
+
+	h.Command = strings.TrimSpace(rest)
+	if h.Command == "" {
+		return h, fmt.Errorf("hook without command: %s", s)
+	}
+
+	return
+}
+
+func (h Hook) triggered(changed []string) (names []string) {
+	for _, n := range changed {
+		if h.matches(n) {
+			names = append(names, n)
+		}
+	}
+	return
+}
+
+func (h Hook) matches(name string) bool {
+	if h.Pattern != "" && matches(h.Pattern, name) {
+		return true
+	}
+	for _, p := range h.Patterns {
+		if matches(p, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Manifest) runHook(ctx context.Context, h Hook, changed []string) error {
+	logger, ctx := logging.WithAttrs(ctx, "phase", h.Phase, "command", h.Command)
+	logger.InfoContext(ctx, "running hook", "changed", len(changed))
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", h.Command)
+	cmd.Dir = m.Root
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"SITEPKG_ROOT=" + m.Root,
+		"SITEPKG_CHANGED=" + strings.Join(changed, "\n"),
+	)
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s hook failed: %s: %v", h.Phase, h.Command, err)
+	}
+	return nil
+}
+
+func (m *Manifest) runHooks(ctx context.Context, phase HookPhase, changed []string) error {
+	for _, h := range m.Hooks {
+		if h.Phase != phase {
+			continue
+		}
+
+		var names []string
+		if phase != HookPre {
+			if names = h.triggered(changed); len(names) == 0 {
+				logging.Get(ctx).DebugContext(ctx, "hook not triggered", "phase", h.Phase, "pattern", h.Pattern)
+				continue
+			}
+		}
+
+		if err := m.runHook(ctx, h, names); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Manifest) hasHooks(phase HookPhase) bool {
+	for _, h := range m.Hooks {
+		if h.Phase == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// fileSHA256 returns the hex encoded SHA256 of an existing regular file, or
+// "" when it does not exist
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	rh := hashed.ReaderSHA256(f)
+	if _, err := io.Copy(io.Discard, rh); err != nil {
+		return "", err
+	}
+	return rh.HexDigest(), nil
+}
+
+// rollback restores the state recorded by the undo
+func (m *Manifest) rollback(ctx context.Context, u *undo) error {
+	var buf bytes.Buffer
+	if err := u.writeTo(&buf); err != nil {
+		return err
+	}
+	return Rollback(ctx, m.Root, &buf)
+}
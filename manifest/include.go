@@ -0,0 +1,127 @@
+package manifest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"rootmos.io/go-utils/logging"
+)
+
+// load parses a manifest file into m, stack being the files including it,
+// skipping files already loaded (e.g. included by several files)
+func (m *Manifest) load(ctx context.Context, path string, stack []string, loaded map[string]bool) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	for i, p := range stack {
+		if p == abs {
+			return fmt.Errorf("include cycle: %s", strings.Join(append(stack[i:], abs), " -> "))
+		}
+	}
+	if loaded[abs] {
+		logging.Get(ctx).DebugContext(ctx, "already loaded", "path", path)
+		return nil
+	}
+	loaded[abs] = true
+	stack = append(stack, abs)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if i, ok := strings.CutPrefix(strings.TrimLeft(line, " \t"), "include "); ok {
+			err = m.include(ctx, path, i, stack, loaded)
+		} else {
+			err = m.parseLine(ctx, fmt.Sprintf("%s:%d", path, n), line)
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+	}
+	return s.Err()
+}
+
+// include loads the manifest files matching the paths or globs of an include
+// directive, relative to the directory of the including file
+func (m *Manifest) include(ctx context.Context, from, directive string, stack []string, loaded map[string]bool) error {
+	logger := logging.Get(ctx)
+
+	ps, err := fields(directive, m.Vars != nil)
+	if err != nil {
+		return err
+	}
+	if ps, err = m.Vars.expandAll(ctx, ps); err != nil {
+		return err
+	}
+	if len(ps) == 0 {
+		return fmt.Errorf("include without path")
+	}
+
+	for _, p := range ps {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(filepath.Dir(from), p)
+		}
+
+		files := []string{ p }
+		if IsGlob(p) {
+			if files, err = filepath.Glob(p); err != nil {
+				return fmt.Errorf("invalid include pattern: %s", p)
+			}
+		}
+
+		for _, i := range files {
+			if IsStructured(i) {
+				return fmt.Errorf("unable to include structured manifest: %s", i)
+			}
+			logger.DebugContext(ctx, "including manifest", "path", i)
+			if err := m.load(ctx, i, stack, loaded); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// contributed records that the path (or exclude) was specified at src
+func (m *Manifest) contributed(p, src string) {
+	if m.Sources == nil {
+		m.Sources = make(map[string][]string)
+	}
+	m.Sources[p] = append(m.Sources[p], src)
+}
+
+// Explain writes the paths and excludes of the manifest along with where they were specified
+func (m *Manifest) Explain(w io.Writer) error {
+	explain := func(p string) error {
+		srcs := m.Sources[p]
+		if len(srcs) == 0 {
+			srcs = []string{ "(command line)" }
+		}
+		_, err := fmt.Fprintf(w, "%s\t%s\n", p, strings.Join(srcs, ", "))
+		return err
+	}
+
+	for _, p := range m.Paths {
+		if err := explain(p); err != nil {
+			return err
+		}
+	}
+	for _, e := range m.Excludes {
+		if err := explain("!" + e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
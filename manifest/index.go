@@ -0,0 +1,197 @@
+package manifest
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"rootmos.io/go-utils/hashed"
+)
+
+const (
+	// the SHA256 of the content of regular files
+	PAXSHA256 = "SITEPKG.sha256"
+	// marks an entry deleted since the base package of an incremental package
+	PAXWhiteout = "SITEPKG.whiteout"
+	// the exact paths skipped (e.g. sockets) when creating, NUL separated in a global header
+	PAXSkipped = "SITEPKG.skipped"
+)
+
+// Whiteout entries are named dir/.wh.name (as in OCI image layers), which
+// extractors unaware of the PAX record create as an empty file beside the
+// deleted one
+const WhiteoutPrefix = ".wh."
+
+// An IndexEntry is the metadata of a packaged path compared when creating incremental packages
+type IndexEntry struct {
+	Typeflag byte
+	Mode int64
+	Uid int
+	Gid int
+	Uname string
+	Gname string
+	Linkname string
+	Devmajor int64
+	Devminor int64
+	Size int64
+	SHA256 string
+	// the extended attribute records, sorted and NUL separated
+	Xattrs string
+	Template bool
+}
+
+type Index map[string]IndexEntry
+
+// Whiteout returns the name deleted by a whiteout entry
+func Whiteout(hdr *tar.Header) (name string, ok bool, err error) {
+	name, ok = hdr.PAXRecords[PAXWhiteout]
+	if !ok {
+		return "", false, nil
+	}
+	if dir, base := path.Split(name); base == "" || hdr.Name != dir + WhiteoutPrefix + base {
+		return "", false, fmt.Errorf("invalid whiteout: %s: %s", hdr.Name, name)
+	}
+	return name, true, nil
+}
+
+func isReserved(name string) bool {
+	return strings.HasPrefix(path.Base(name), WhiteoutPrefix)
+}
+
+func whiteout(name string) *tar.Header {
+	dir, base := path.Split(name)
+	return &tar.Header {
+		Typeflag: tar.TypeReg,
+		Name: dir + WhiteoutPrefix + base,
+		Mode: 0600,
+		Format: tar.FormatPAX,
+		PAXRecords: map[string]string {
+			PAXWhiteout: name,
+		},
+	}
+}
+
+func indexEntry(hdr *tar.Header) IndexEntry {
+	return IndexEntry {
+		Typeflag: hdr.Typeflag,
+		Mode: hdr.Mode,
+		Uid: hdr.Uid,
+		Gid: hdr.Gid,
+		Uname: hdr.Uname,
+		Gname: hdr.Gname,
+		Linkname: hdr.Linkname,
+		Devmajor: hdr.Devmajor,
+		Devminor: hdr.Devminor,
+		Size: hdr.Size,
+		SHA256: hdr.PAXRecords[PAXSHA256],
+		Xattrs: xattrRecords(hdr),
+		Template: hdr.PAXRecords[PAXTemplate] != "",
+	}
+}
+
+func xattrRecords(hdr *tar.Header) string {
+	var rs []string
+	for k, v := range hdr.PAXRecords {
+		if strings.HasPrefix(k, PAXXattrPrefix) {
+			rs = append(rs, k + "=" + v)
+		}
+	}
+	sort.Strings(rs)
+	return strings.Join(rs, "\x00")
+}
+
+func ReadIndex(r io.Reader) (Index, error) {
+	idx := make(Index)
+	return idx, idx.Update(r)
+}
+
+// Update applies a (possibly incremental) tarball to the index
+func (idx Index) Update(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		if n, ok, err := Whiteout(hdr); err != nil {
+			return err
+		} else if ok {
+			delete(idx, n)
+			continue
+		}
+
+		e := indexEntry(hdr)
+		if hdr.Typeflag == tar.TypeReg && e.SHA256 == "" {
+			// packages created before the SHA256 was recorded
+			rh := hashed.ReaderSHA256(tr)
+			if _, err := io.Copy(io.Discard, rh); err != nil {
+				return err
+			}
+			e.SHA256 = rh.HexDigest()
+		}
+
+		idx[hdr.Name] = e
+	}
+}
+
+// Digest returns the SHA256 of the entries (and whiteouts) of a tarball as
+// indexed, i.e. unlike the SHA256 of the tarball itself independent of times
+func Digest(r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return h.Sum(nil), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			if _, err := fmt.Fprintf(h, "skipped %q\n", skippedNames(hdr)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if n, ok, err := Whiteout(hdr); err != nil {
+			return nil, err
+		} else if ok {
+			if _, err := fmt.Fprintf(h, "whiteout %q\n", n); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		e := indexEntry(hdr)
+		if hdr.Typeflag == tar.TypeReg && e.SHA256 == "" {
+			rh := hashed.ReaderSHA256(tr)
+			if _, err := io.Copy(io.Discard, rh); err != nil {
+				return nil, err
+			}
+			e.SHA256 = rh.HexDigest()
+		}
+
+		if _, err := fmt.Fprintf(h, "%q %+v\n", hdr.Name, e); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (idx Index) Unchanged(hdr *tar.Header) bool {
+	e, ok := idx[hdr.Name]
+	return ok && e == indexEntry(hdr)
+}
@@ -3,14 +3,13 @@ package manifest
 import (
 	"os"
 	"path/filepath"
-	"bufio"
 	"io"
 	"archive/tar"
 	"context"
 	"fmt"
-	"os/user"
-	"strconv"
+	"sort"
 	"syscall"
+	"time"
 
 	"rootmos.io/go-utils/hashed"
 	"rootmos.io/go-utils/logging"
@@ -20,6 +19,60 @@ type Manifest struct {
 	Root string
 	IgnoreMissing bool
 	Paths []string
+	Excludes []string
+
+	// the manifest files (and lines) contributing each path and exclude (prefixed by !)
+	Sources map[string][]string
+
+	// paths which may be missing
+	Optional map[string]bool
+	// paths of which existing files are not overwritten when extracting
+	NoReplace []string
+	// paths of files rendered as templates when extracting (see Facts)
+	Templates []string
+
+	// variables expanded when loading and available to templates
+	Vars *Vars
+
+	// remove files below recursive and glob paths not present in the tarball
+	Sync bool
+	// move files removed when syncing here instead of deleting them
+	BackupDir string
+
+	// when set, Extract writes a tarball here restoring the state prior to the extraction (see Rollback)
+	Undo io.Writer
+
+	Hooks []Hook
+
+	// when set, Create normalizes the entries and orders them by name
+	Reproducible *Reproducible
+
+	// extended attributes to capture and restore, none when nil
+	Xattrs *Xattrs
+
+	// owner, group and mode of extracted entries
+	OwnerMap IdMap
+	GroupMap IdMap
+	// ignore user and group names, mapping only numeric ids
+	NumericOwner bool
+	// leave extracted files owned by the extracting user
+	NoSameOwner bool
+	Overrides []Override
+
+	// settings of a structured manifest
+	Package *Package
+
+	// how device nodes, FIFOs and sockets are handled
+	Special SpecialPolicy
+
+	// store symlinks as such instead of the content of their targets
+	Symlinks bool
+	// record access times (and sub-second modification times) when creating
+	AccessTimes bool
+	// don't restore access and modification times when extracting
+	NoTimes bool
+	// don't restore the times of directories (applied after their entries otherwise)
+	NoDirTimes bool
 }
 
 func (m *Manifest) Resolve(ctx context.Context, p string) string {
@@ -34,6 +87,33 @@ func (m *Manifest) Resolve(ctx context.Context, p string) string {
 	return q
 }
 
+// checkParents refuses relative names of which a parent directory below the
+// root is a symlink, through which the entry would end up outside of the root
+func (m *Manifest) checkParents(name string) error {
+	if !filepath.IsLocal(name) {
+		return nil
+	}
+
+	var ds []string
+	for d := filepath.Dir(filepath.Clean(name)); d != "."; d = filepath.Dir(d) {
+		ds = append(ds, d)
+	}
+
+	for i := len(ds) - 1; i >= 0; i-- {
+		fi, err := os.Lstat(filepath.Join(m.Root, ds[i]))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode().Type() == os.ModeSymlink {
+			return fmt.Errorf("refusing to extract through symlink: %s: %s", ds[i], name)
+		}
+	}
+	return nil
+}
+
 func (m *Manifest) Has(path string) bool {
 	for _, p := range m.Paths {
 		if p == path {
@@ -49,33 +129,46 @@ func (m *Manifest) Add(path string) {
 	}
 }
 
-func Load(ctx context.Context, path, root string) (m *Manifest, err error) {
-	logger, ctx := logging.WithAttrs(ctx, "manifest", path)
+func (m *Manifest) Exclude(pattern string) {
+	for _, e := range m.Excludes {
+		if e == pattern {
+			return
+		}
+	}
+	m.Excludes = append(m.Excludes, pattern)
+}
 
-	f, err := os.Open(path)
-	if err != nil {
-		return
+// Load loads a line-oriented manifest (see parse.go) or a structured one (see Document)
+func Load(ctx context.Context, path, root string) (*Manifest, error) {
+	return LoadVars(ctx, path, root, nil)
+}
+
+// LoadVars loads a manifest expanding the variables (see Vars)
+func LoadVars(ctx context.Context, path, root string, vars *Vars) (m *Manifest, err error) {
+	_, ctx = logging.WithAttrs(ctx, "manifest", path)
+
+	if IsStructured(path) {
+		return loadDocument(ctx, path, root, vars)
 	}
-	defer f.Close()
 
 	m = &Manifest{
 		Root: root,
+		Vars: vars,
 	}
-
-	s := bufio.NewScanner(f)
-	for s.Scan() {
-		p := s.Text()
-		logger.DebugContext(ctx, "adding path to manifest", "path", p)
-		m.Paths = append(m.Paths, p)
-	}
-	if err = s.Err(); err != nil {
-		return
+	if err = m.load(ctx, path, nil, make(map[string]bool)); err != nil {
+		return nil, err
 	}
 
 	return m, nil
 }
 
 func (m *Manifest) Create(ctx context.Context, w io.Writer) (err error) {
+	return m.CreateIncremental(ctx, w, nil)
+}
+
+// CreateIncremental omits the entries unchanged since the base package and
+// records whiteouts for the entries of the base no longer present
+func (m *Manifest) CreateIncremental(ctx context.Context, w io.Writer, base Index) (err error) {
 	tw := tar.NewWriter(w)
 	defer func() {
 		if e := tw.Close(); err == nil {
@@ -83,12 +176,23 @@ func (m *Manifest) Create(ctx context.Context, w io.Writer) (err error) {
 		}
 	}()
 
+	present := make(map[string]bool)
+	links := make(hardlinks)
+	// the names written to respectively omitted (as unchanged) from the tarball
+	written, unchanged := make(map[string]bool), make(map[string]bool)
+	// exact paths of the manifest skipped by the special files policy
+	var skipped []string
+
 	add := func(p string) (err error) {
 		path := m.Resolve(ctx, p)
 		logger, ctx := logging.WithAttrs(ctx, "name", p, "path", path)
 
-		fi, err := os.Stat(path)
-		if os.IsNotExist(err) && m.IgnoreMissing {
+		stat := os.Stat
+		if m.Symlinks {
+			stat = os.Lstat
+		}
+		fi, err := stat(path)
+		if os.IsNotExist(err) && m.missingOk(p) {
 			logger.InfoContext(ctx, "ignoring missing")
 			return nil
 		}
@@ -98,8 +202,107 @@ func (m *Manifest) Create(ctx context.Context, w io.Writer) (err error) {
 
 		logger, ctx = logging.WithAttrs(ctx, "mode", fi.Mode())
 
-		hdr, err := tar.FileInfoHeader(fi, "")
+		var link string
+		if fi.Mode().Type() == os.ModeSymlink {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		} else if isSpecial(fi.Mode()) {
+			if ok, err := m.includeSpecial(ctx, p, fi.Mode()); !ok {
+				if err == nil && IsExact(p) && m.Has(p) {
+					skipped = append(skipped, p)
+				}
+				return err
+			}
+		} else if !fi.IsDir() && !fi.Mode().IsRegular() {
+			return fmt.Errorf("non-regular files not supported: %s", path)
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
 		hdr.Name = p
+		hdr.ChangeTime = time.Time{}
+		if m.AccessTimes {
+			// PAX, to record access times and sub-second modification times
+			hdr.Format = tar.FormatPAX
+		} else {
+			hdr.AccessTime = time.Time{}
+		}
+		m.Reproducible.normalize(hdr)
+
+		if err = m.Xattrs.capture(ctx, path, hdr); err != nil {
+			return err
+		}
+
+		present[p] = true
+
+		target, linked := links.seen(fi, p)
+		if linked && !written[target] && unchanged[target] {
+			if e, ok := base[p]; ok && e.Typeflag == tar.TypeLink && e.Linkname == target {
+				logger.InfoContext(ctx, "unchanged")
+				unchanged[p] = true
+				return nil
+			}
+		}
+
+		var f *os.File
+		if linked && written[target] {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = target
+			hdr.Size = 0
+			// the extended attributes belong to the target
+			hdr.PAXRecords = nil
+		} else if fi.Mode().IsRegular() {
+			f, err = os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if e := f.Close(); err == nil {
+					err = e
+				}
+			}()
+
+			rh := hashed.ReaderSHA256(f)
+			if _, err = io.Copy(io.Discard, rh); err != nil {
+				return err
+			}
+			if _, err = f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = make(map[string]string)
+			}
+			hdr.PAXRecords[PAXSHA256] = rh.HexDigest()
+			if m.isTemplate(p) {
+				hdr.PAXRecords[PAXTemplate] = "1"
+			}
+		}
+
+		// links are written along with their (changed) targets
+		if base != nil && hdr.Typeflag != tar.TypeLink && base.Unchanged(hdr) {
+			logger.InfoContext(ctx, "unchanged")
+			unchanged[p] = true
+			return nil
+		}
+		written[p] = true
+
+		if f != nil && hdr.Typeflag == tar.TypeReg {
+			segs, err := dataSegments(f, hdr.Size)
+			if err != nil {
+				return err
+			}
+			if isSparse(segs, hdr.Size) {
+				if err := writeSparse(w, tw, hdr, f, segs); err != nil {
+					return err
+				}
+				logger.InfoContext(ctx, "add sparse file", "bytes", hdr.Size, "segments", len(segs), "SHA256", hdr.PAXRecords[PAXSHA256])
+				return nil
+			}
+		}
 
 		if err = tw.WriteHeader(hdr); err != nil {
 			return err
@@ -110,50 +313,176 @@ func (m *Manifest) Create(ctx context.Context, w io.Writer) (err error) {
 			return nil
 		}
 
-		if !fi.Mode().IsRegular() {
-			// TODO: symlinks
-			return fmt.Errorf("non-regular files not supported: %s", path)
+		if hdr.Typeflag == tar.TypeLink {
+			logger.InfoContext(ctx, "add hard link", "target", hdr.Linkname)
+			return nil
 		}
 
-		f, err := os.Open(path)
-		if err != nil {
-			return err
+		if isSpecial(fi.Mode()) {
+			logger.InfoContext(ctx, "add special file", "major", hdr.Devmajor, "minor", hdr.Devminor)
+			return nil
 		}
-		defer func() {
-			if e := f.Close(); err == nil {
-				err = e
-			}
-		}()
 
-		rh := hashed.ReaderSHA256(f)
-		n, err := io.Copy(tw, rh)
+		if f == nil {
+			logger.InfoContext(ctx, "add symlink", "target", link)
+			return nil
+		}
+
+		n, err := io.Copy(tw, f)
 		if err != nil {
 			return err
 		}
-		logger.InfoContext(ctx, "add file", "bytes", n, "SHA256", rh.HexDigest())
+		logger.InfoContext(ctx, "add file", "bytes", n, "SHA256", hdr.PAXRecords[PAXSHA256])
 
 		return
 	}
 
+	var names []string
 	for _, p := range m.Paths {
-		if err = add(p); err != nil {
+		if IsExact(p) && isReserved(p) {
+			return fmt.Errorf("reserved name (whiteout): %s", p)
+		}
+
+		ns, err := m.Expand(ctx, p)
+		if os.IsNotExist(err) && m.missingOk(p) {
+			logging.Get(ctx).InfoContext(ctx, "ignoring missing", "name", p)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		names = append(names, ns...)
+	}
+
+	if m.Reproducible != nil {
+		// parent directories sort before their entries
+		sort.Strings(names)
+	}
+
+	for _, n := range names {
+		if present[n] {
+			continue
+		}
+		if err = add(n); err != nil {
+			return err
+		}
+	}
+
+	var deleted []string
+	for p := range base {
+		if !present[p] {
+			deleted = append(deleted, p)
+		}
+	}
+	sort.Strings(deleted)
+
+	for _, p := range deleted {
+		logger := logging.Get(ctx)
+		logger.InfoContext(ctx, "whiteout", "name", p)
+		if err = tw.WriteHeader(whiteout(p)); err != nil {
 			return
 		}
 	}
 
+	if len(skipped) > 0 {
+		err = tw.WriteHeader(skippedHeader(skipped))
+	}
+
 	return
 }
 
 func (m *Manifest) Extract(ctx context.Context, r io.Reader) error {
+	return m.ExtractChain(ctx, r)
+}
+
+// ExtractChain extracts a base package followed by incremental packages
+func (m *Manifest) ExtractChain(ctx context.Context, rs ...io.Reader) (err error) {
 	logger := logging.Get(ctx)
-	tr := tar.NewReader(r)
 
-	extract := func(hdr *tar.Header) (err error) {
+	var u *undo
+	if m.Undo != nil || m.hasHooks(HookValidate) {
+		u = newUndo()
+	}
+
+	if m.Undo != nil {
+		// also (especially) after a partial extraction
+		defer func() {
+			if err != nil && len(u.entries) == 0 {
+				return
+			}
+			if e := u.writeTo(m.Undo); err == nil {
+				err = e
+			}
+		}()
+	}
+
+	if err := m.runHooks(ctx, HookPre, nil); err != nil {
+		return err
+	}
+
+	changed := make(map[string]bool)
+
+	// directory times are restored after their entries have been written
+	var dirs []*tar.Header
+
+	extracted := make(map[string]bool)
+	// exact paths skipped when creating the packages
+	skipped := make(map[string]bool)
+	// noreplace entries absent before the extraction, i.e. replaced by later packages of the chain
+	absent := make(map[string]bool)
+
+	remove := func(name string) (err error) {
+		path := m.Resolve(ctx, name)
+		logger, _ := logging.WithAttrs(ctx, "name", name, "path", path)
+
+		if err := m.checkParents(name); err != nil {
+			return err
+		}
+
+		if err := u.save(ctx, path, name); err != nil {
+			return err
+		}
+
+		logger.InfoContext(ctx, "remove")
+		err = os.Remove(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		changed[name] = err == nil
+		return
+	}
+
+	extract := func(tr *tar.Reader, hdr *tar.Header) (err error) {
 		path := m.Resolve(ctx, hdr.Name)
+		m.overrideMode(hdr)
 		fi := hdr.FileInfo()
 		mode := fi.Mode()
 		logger, _ := logging.WithAttrs(ctx, "name", hdr.Name, "path", path, "mode", mode)
 
+		if err := m.checkParents(hdr.Name); err != nil {
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeDir && m.noReplace(hdr.Name) && !absent[hdr.Name] {
+			if _, err := os.Lstat(path); err == nil {
+				logger.InfoContext(ctx, "exists; not replacing")
+				return nil
+			}
+			absent[hdr.Name] = true
+		}
+
+		if err := u.save(ctx, path, hdr.Name); err != nil {
+			return err
+		}
+
+		// replace existing symlinks instead of following them
+		if fi, err := os.Lstat(path); err == nil && fi.Mode().Type() == os.ModeSymlink && hdr.Typeflag != tar.TypeSymlink {
+			logger.InfoContext(ctx, "replacing symlink")
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+
 		if hdr.Typeflag == tar.TypeDir {
 			logger.InfoContext(ctx, "mkdir")
 			oldmask := syscall.Umask(0)
@@ -161,17 +490,47 @@ func (m *Manifest) Extract(ctx context.Context, r io.Reader) error {
 			syscall.Umask(oldmask)
 			if os.IsExist(err) {
 				err = nil
+			} else {
+				changed[hdr.Name] = err == nil
+			}
+			if err == nil {
+				dirs = append(dirs, hdr)
+				err = m.Xattrs.restore(ctx, path, hdr)
 			}
 			return
 		}
 
+		if hdr.Typeflag == tar.TypeSymlink {
+			return m.symlink(ctx, path, hdr, changed)
+		}
+
+		if hdr.Typeflag == tar.TypeLink {
+			return m.link(ctx, path, hdr, extracted, changed)
+		}
+
+		if isSpecialType(hdr.Typeflag) {
+			if ok, err := m.includeSpecial(ctx, hdr.Name, mode); !ok {
+				return err
+			}
+			if ok, err := m.mknod(ctx, path, hdr, changed); !ok {
+				return err
+			}
+			_, _, err = m.setAttributes(ctx, path, hdr)
+			return
+		}
+
 		if hdr.Typeflag != tar.TypeReg {
 			return fmt.Errorf("non-regular files not supported: %s", hdr.Name)
 		}
 
+		prev, err := fileSHA256(path)
+		if err != nil {
+			return err
+		}
+
 		logger.DebugContext(ctx, "opening")
 		oldmask := syscall.Umask(0)
-		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, mode)
 		syscall.Umask(oldmask)
 		if err != nil {
 			return err
@@ -184,68 +543,107 @@ func (m *Manifest) Extract(ctx context.Context, r io.Reader) error {
 
 		logger.DebugContext(ctx, "writing")
 		rh := hashed.ReaderSHA256(tr)
-		n, err := io.Copy(f, rh)
+		var n int64
+		var digest string
+		if _, ok := hdr.PAXRecords[PAXTemplate]; ok || m.isTemplate(hdr.Name) {
+			logger.DebugContext(ctx, "rendering template")
+			n, digest, err = m.render(hdr.Name, f, rh)
+		} else if _, sparse := hdr.PAXRecords[PAXSparseMajor]; sparse {
+			n, err = copySparse(f, rh)
+		} else {
+			n, err = io.Copy(f, rh)
+		}
 		if err != nil {
 			return
 		}
 
-		uid := hdr.Uid
-		u, err := user.Lookup(hdr.Uname)
-		if err == nil {
-			if id, err := strconv.Atoi(u.Uid); err == nil {
-				uid = id
-			}
+		if expected, ok := hdr.PAXRecords[PAXSHA256]; ok && expected != rh.HexDigest() {
+			return fmt.Errorf("SHA256 mismatch: %s: %s != %s (expected)", hdr.Name, rh.HexDigest(), expected)
 		}
 
-		gid := hdr.Gid
-		g, err := user.LookupGroup(hdr.Uname)
-		if err == nil {
-			if id, err := strconv.Atoi(g.Gid); err == nil {
-				gid = id
-			}
+		if digest == "" {
+			digest = rh.HexDigest()
 		}
-
-		err = os.Chown(path, uid, gid)
-		if err != nil {
-			return
+		if prev != digest {
+			changed[hdr.Name] = true
 		}
 
-		err = os.Chmod(path, mode)
+		uid, gid, err := m.setAttributes(ctx, path, hdr)
 		if err != nil {
 			return
 		}
 
-		logger.InfoContext(ctx, "extracted file", "bytes", n, "SHA256", rh.HexDigest(), "uid", uid, "gid", gid)
+		logger.InfoContext(ctx, "extracted file", "bytes", n, "SHA256", digest, "uid", uid, "gid", gid)
 
 		return
 	}
 
-	extracted := make(map[string]bool)
+	for _, r := range rs {
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
 
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
+			if hdr.Typeflag == tar.TypeXGlobalHeader {
+				for _, n := range skippedNames(hdr) {
+					skipped[n] = true
+				}
+				continue
+			}
 
-		if !m.Has(hdr.Name) {
-			logger.DebugContext(ctx, "skipping", "name", hdr.Name)
-			continue
+			name, isWhiteout, err := Whiteout(hdr)
+			if err != nil {
+				return err
+			}
+			if !isWhiteout {
+				name = hdr.Name
+			}
+
+			if !m.Match(name) {
+				logger.DebugContext(ctx, "skipping", "name", name)
+				continue
+			}
+
+			if isWhiteout {
+				err = remove(name)
+			} else {
+				err = extract(tr, hdr)
+			}
+			if err != nil {
+				return err
+			}
+
+			extracted[name] = true
 		}
+	}
 
-		if err := extract(hdr); err != nil {
+	if m.Sync {
+		if err := m.sync(ctx, extracted, u, changed); err != nil {
 			return err
 		}
+	}
 
-		extracted[hdr.Name] = true
+	if !m.NoTimes && !m.NoDirTimes {
+		for i := len(dirs) - 1; i >= 0; i-- {
+			if err := chtimes(m.Resolve(ctx, dirs[i].Name), dirs[i]); err != nil {
+				return err
+			}
+		}
 	}
 
 	for _, p := range m.Paths {
+		if !IsExact(p) {
+			continue
+		}
 		if !extracted[p] {
-			if m.IgnoreMissing {
+			if skipped[p] {
+				logger.InfoContext(ctx, "skipped when creating", "name", p)
+			} else if m.missingOk(p) {
 				logger.InfoContext(ctx, "missing", "name", p)
 			} else {
 				return fmt.Errorf("not found in tarball: %s", p)
@@ -253,5 +651,87 @@ func (m *Manifest) Extract(ctx context.Context, r io.Reader) error {
 		}
 	}
 
+	var names []string
+	for n, ok := range changed {
+		if ok {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+
+	if err := m.runHooks(ctx, HookValidate, names); err != nil {
+		logger.WarnContext(ctx, "validation failed: rolling back", "err", err)
+		if e := m.rollback(ctx, u); e != nil {
+			return fmt.Errorf("unable to roll back (%v) after: %v", e, err)
+		}
+		// nothing left to undo: leave the rollback history unchanged
+		u.entries = nil
+		return err
+	}
+
+	return m.runHooks(ctx, HookPost, names)
+}
+
+// chown sets the owner of an extracted file, unless NoSameOwner
+func (m *Manifest) chown(path string, hdr *tar.Header, chown func(string, int, int) error) (uid, gid int, err error) {
+	if m.NoSameOwner {
+		return os.Getuid(), os.Getgid(), nil
+	}
+
+	if uid, gid, err = m.owner(hdr); err != nil {
+		return
+	}
+
+	err = chown(path, uid, gid)
+	return
+}
+
+// setAttributes sets the owner, mode, extended attributes and times of an extracted file
+func (m *Manifest) setAttributes(ctx context.Context, path string, hdr *tar.Header) (uid, gid int, err error) {
+	if uid, gid, err = m.chown(path, hdr, os.Chown); err != nil {
+		return
+	}
+
+	if err = os.Chmod(path, hdr.FileInfo().Mode()); err != nil {
+		return
+	}
+
+	// after chown, which clears file capabilities (security.capability)
+	if err = m.Xattrs.restore(ctx, path, hdr); err != nil {
+		return
+	}
+
+	if !m.NoTimes {
+		err = chtimes(path, hdr)
+	}
+
+	return
+}
+
+func (m *Manifest) symlink(ctx context.Context, path string, hdr *tar.Header, changed map[string]bool) error {
+	logger := logging.Get(ctx)
+
+	if prev, err := os.Readlink(path); err != nil || prev != hdr.Linkname {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Symlink(hdr.Linkname, path); err != nil {
+			return err
+		}
+		changed[hdr.Name] = true
+	}
+
+	uid, gid, err := m.chown(path, hdr, os.Lchown)
+	if err != nil {
+		return err
+	}
+
+	if !m.NoTimes {
+		if err := chtimes(path, hdr); err != nil {
+			return err
+		}
+	}
+
+	logger.InfoContext(ctx, "extracted symlink", "name", hdr.Name, "target", hdr.Linkname, "uid", uid, "gid", gid)
 	return nil
 }
@@ -1,6 +1,7 @@
 package manifest
 
 import (
+	"archive/tar"
 	"log"
 	"testing"
 	"path/filepath"
@@ -17,6 +18,13 @@ import (
 	"strconv"
 	"syscall"
 	"fmt"
+	"compress/gzip"
+	"reflect"
+	"errors"
+	"net"
+	"encoding/binary"
+	"slices"
+	"os/exec"
 
 	logging "rootmos.io/go-utils/logging/testing"
 )
@@ -663,3 +671,1696 @@ func TestRoundtripNonlocalFile(t *testing.T) {
 
 	CheckFile(t, foo, bs)
 }
+
+func TarballNames(t *testing.T, bs []byte) (names []string, whiteouts []string) {
+	tr := tar.NewReader(bytes.NewReader(bs))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatalf("unable to read tarball: %v", err)
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		n, ok, err := Whiteout(hdr)
+		Must0(err)
+		if ok {
+			whiteouts = append(whiteouts, n)
+		} else {
+			names = append(names, hdr.Name)
+		}
+	}
+}
+
+func TestIncremental(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	a := filepath.Join(tmp, "a")
+	_ = PopulateFile(t, filepath.Join(a, "foo"))
+	bar := PopulateFile(t, filepath.Join(a, "bar"))
+	qux := PopulateFile(t, filepath.Join(a, "qux"))
+
+	m0 := &Manifest {
+		Root: a,
+		IgnoreMissing: true,
+		Paths: []string{
+			"foo",
+			"bar",
+			"baz",
+			"qux",
+		},
+	}
+
+	var base bytes.Buffer
+	if err := m0.Create(ctx, &base); err != nil {
+		t.Fatalf("unable to create tarball: %v", err)
+	}
+
+	idx, err := ReadIndex(bytes.NewReader(base.Bytes()))
+	if err != nil {
+		t.Fatalf("unable to read index: %v", err)
+	}
+
+	foo := PopulateFile(t, filepath.Join(a, "foo"))
+	Must0(os.Remove(filepath.Join(a, "bar")))
+	baz := PopulateFile(t, filepath.Join(a, "baz"))
+
+	var inc bytes.Buffer
+	if err := m0.CreateIncremental(ctx, &inc, idx); err != nil {
+		t.Fatalf("unable to create incremental tarball: %v", err)
+	}
+
+	names, whiteouts := TarballNames(t, inc.Bytes())
+	if fmt.Sprint(names) != "[foo baz]" {
+		t.Errorf("unexpected entries: %v", names)
+	}
+	if fmt.Sprint(whiteouts) != "[bar]" {
+		t.Errorf("unexpected whiteouts: %v", whiteouts)
+	}
+
+	b := filepath.Join(tmp, "b")
+	Must0(os.Mkdir(b, 0755))
+	m1 := &Manifest {
+		Root: b,
+		Paths: m0.Paths,
+	}
+
+	if err := m1.ExtractChain(ctx, &base, &inc); err != nil {
+		t.Fatalf("unable to extract chain: %v", err)
+	}
+
+	CheckFile(t, filepath.Join(b, "foo"), foo)
+	CheckFile(t, filepath.Join(b, "baz"), baz)
+	CheckFile(t, filepath.Join(b, "qux"), qux)
+	if _, err := os.Stat(filepath.Join(b, "bar")); !os.IsNotExist(err) {
+		t.Errorf("whiteout not applied: %v (%d bytes in base)", err, len(bar))
+	}
+}
+
+func TestRoundtripRecursiveWithExcludes(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	a := filepath.Join(tmp, "a")
+	foo := PopulateFile(t, filepath.Join(a, "dir", "foo"))
+	bar := PopulateFile(t, filepath.Join(a, "dir", "sub", "bar"))
+	_ = PopulateFile(t, filepath.Join(a, "dir", "sub", "bar.swp"))
+	_ = PopulateFile(t, filepath.Join(a, "dir", "cache", "baz"))
+
+	m0 := &Manifest {
+		Root: a,
+		Paths: []string{ "dir/**" },
+		Excludes: []string{ "dir/cache/**", "*/*/*.swp" },
+	}
+
+	var buf bytes.Buffer
+	if err := m0.Create(ctx, &buf); err != nil {
+		t.Fatalf("unable to create tarball: %v", err)
+	}
+
+	names, _ := TarballNames(t, buf.Bytes())
+	if fmt.Sprint(names) != "[dir dir/foo dir/sub dir/sub/bar]" {
+		t.Errorf("unexpected entries: %v", names)
+	}
+
+	b := filepath.Join(tmp, "b")
+	Must0(os.Mkdir(b, 0755))
+	m1 := &Manifest {
+		Root: b,
+		Paths: m0.Paths,
+		Excludes: m0.Excludes,
+	}
+
+	if err := m1.Extract(ctx, &buf); err != nil {
+		t.Fatalf("unable to extract tarball: %v", err)
+	}
+
+	CheckFile(t, filepath.Join(b, "dir", "foo"), foo)
+	CheckFile(t, filepath.Join(b, "dir", "sub", "bar"), bar)
+}
+
+func TestSync(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	a := filepath.Join(tmp, "a")
+	foo := PopulateFile(t, filepath.Join(a, "vhosts", "foo.conf"))
+
+	m0 := &Manifest {
+		Root: a,
+		Paths: []string{ "vhosts/**", "*.conf" },
+		Excludes: []string{ "vhosts/local.conf" },
+	}
+
+	var buf bytes.Buffer
+	if err := m0.Create(ctx, &buf); err != nil {
+		t.Fatalf("unable to create tarball: %v", err)
+	}
+
+	b := filepath.Join(tmp, "b")
+	stale := PopulateFile(t, filepath.Join(b, "vhosts", "removed.conf"))
+	_ = PopulateFile(t, filepath.Join(b, "vhosts", "gone", "old.conf"))
+	local := PopulateFile(t, filepath.Join(b, "vhosts", "local.conf"))
+	top := PopulateFile(t, filepath.Join(b, "top.conf"))
+	outside := PopulateFile(t, filepath.Join(b, "other", "keep.conf"))
+
+	backup := filepath.Join(tmp, "backup")
+	m1 := &Manifest {
+		Root: b,
+		Paths: []string{ "vhosts/**" },
+		Excludes: m0.Excludes,
+		Sync: true,
+		BackupDir: backup,
+	}
+
+	if err := m1.Extract(ctx, &buf); err != nil {
+		t.Fatalf("unable to extract tarball: %v", err)
+	}
+
+	CheckFile(t, filepath.Join(b, "vhosts", "foo.conf"), foo)
+	CheckFile(t, filepath.Join(b, "vhosts", "local.conf"), local)
+	CheckFile(t, filepath.Join(b, "top.conf"), top)
+	CheckFile(t, filepath.Join(b, "other", "keep.conf"), outside)
+
+	for _, p := range []string{ "vhosts/removed.conf", "vhosts/gone/old.conf", "vhosts/gone" } {
+		if _, err := os.Lstat(filepath.Join(b, p)); !os.IsNotExist(err) {
+			t.Errorf("stale path not removed: %s (%v)", p, err)
+		}
+	}
+
+	CheckFile(t, filepath.Join(backup, "vhosts", "removed.conf"), stale)
+}
+
+func TestSyncThroughSymlink(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	a := filepath.Join(tmp, "a")
+	foo := PopulateFile(t, filepath.Join(a, "vhosts", "site", "foo.conf"))
+
+	m0 := &Manifest {
+		Root: a,
+		Paths: []string{ "vhosts", "vhosts/site", "vhosts/*/*.conf" },
+	}
+
+	var buf bytes.Buffer
+	if err := m0.Create(ctx, &buf); err != nil {
+		t.Fatalf("unable to create tarball: %v", err)
+	}
+
+	b := filepath.Join(tmp, "b")
+	Must0(os.MkdirAll(filepath.Join(b, "vhosts"), 0755))
+	outside := PopulateFile(t, filepath.Join(tmp, "outside", "keep.conf"))
+	Must0(os.Symlink(filepath.Join(tmp, "outside"), filepath.Join(b, "vhosts", "link")))
+
+	m1 := &Manifest {
+		Root: b,
+		Paths: m0.Paths,
+		Sync: true,
+	}
+
+	if err := m1.Extract(ctx, &buf); err != nil {
+		t.Fatalf("unable to extract tarball: %v", err)
+	}
+
+	CheckFile(t, filepath.Join(b, "vhosts", "site", "foo.conf"), foo)
+	CheckFile(t, filepath.Join(tmp, "outside", "keep.conf"), outside)
+}
+
+func TestRollback(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	a := filepath.Join(tmp, "a")
+	_ = PopulateFile(t, filepath.Join(a, "foo"))
+	_ = PopulateFile(t, filepath.Join(a, "dir", "bar"))
+
+	m0 := &Manifest {
+		Root: a,
+		Paths: []string{ "foo", "dir", "dir/bar" },
+	}
+
+	var buf bytes.Buffer
+	if err := m0.Create(ctx, &buf); err != nil {
+		t.Fatalf("unable to create tarball: %v", err)
+	}
+
+	b := filepath.Join(tmp, "b")
+	foo := PopulateFile(t, filepath.Join(b, "foo"))
+
+	var undo bytes.Buffer
+	m1 := &Manifest {
+		Root: b,
+		Paths: m0.Paths,
+		Undo: &undo,
+	}
+
+	if err := m1.Extract(ctx, &buf); err != nil {
+		t.Fatalf("unable to extract tarball: %v", err)
+	}
+
+	if err := Rollback(ctx, b, &undo); err != nil {
+		t.Fatalf("unable to rollback: %v", err)
+	}
+
+	CheckFile(t, filepath.Join(b, "foo"), foo)
+	for _, p := range []string{ "dir/bar", "dir" } {
+		if _, err := os.Lstat(filepath.Join(b, p)); !os.IsNotExist(err) {
+			t.Errorf("not removed by rollback: %s (%v)", p, err)
+		}
+	}
+}
+
+func TestPostHookOnlyWhenChanged(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	a := filepath.Join(tmp, "a")
+	_ = PopulateFile(t, filepath.Join(a, "foo"))
+	_ = PopulateFile(t, filepath.Join(a, "bar"))
+
+	m0 := &Manifest {
+		Root: a,
+		Paths: []string{ "foo", "bar" },
+	}
+
+	var buf bytes.Buffer
+	if err := m0.Create(ctx, &buf); err != nil {
+		t.Fatalf("unable to create tarball: %v", err)
+	}
+	bs := buf.Bytes()
+
+	b := filepath.Join(tmp, "b")
+	Must0(os.Mkdir(b, 0755))
+	out := filepath.Join(tmp, "out")
+
+	m1 := &Manifest {
+		Root: b,
+		Paths: m0.Paths,
+		Hooks: []Hook{
+			Must(ParseHook(`post foo echo "$SITEPKG_CHANGED" >> ` + out)),
+			Must(ParseHook(`post baz echo baz >> ` + out)),
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := m1.Extract(ctx, bytes.NewReader(bs)); err != nil {
+			t.Fatalf("unable to extract tarball: %v", err)
+		}
+	}
+
+	if got := string(Must(os.ReadFile(out))); got != "foo\n" {
+		t.Errorf("unexpected hook invocations: %q", got)
+	}
+}
+
+func TestValidateHookRollsBack(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	a := filepath.Join(tmp, "a")
+	_ = PopulateFile(t, filepath.Join(a, "foo"))
+	_ = PopulateFile(t, filepath.Join(a, "bar"))
+
+	m0 := &Manifest {
+		Root: a,
+		Paths: []string{ "foo", "bar" },
+	}
+
+	var buf bytes.Buffer
+	if err := m0.Create(ctx, &buf); err != nil {
+		t.Fatalf("unable to create tarball: %v", err)
+	}
+
+	b := filepath.Join(tmp, "b")
+	foo := PopulateFile(t, filepath.Join(b, "foo"))
+
+	m1 := &Manifest {
+		Root: b,
+		Paths: m0.Paths,
+		Hooks: []Hook{ Must(ParseHook("validate foo false")) },
+	}
+
+	if err := m1.Extract(ctx, &buf); err == nil {
+		t.Fatalf("unexpected success")
+	}
+
+	CheckFile(t, filepath.Join(b, "foo"), foo)
+	if _, err := os.Lstat(filepath.Join(b, "bar")); !os.IsNotExist(err) {
+		t.Errorf("not removed by rollback: bar (%v)", err)
+	}
+}
+
+func TestValidateHookRollsBackWithoutUndo(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	a := filepath.Join(tmp, "a")
+	_ = PopulateFile(t, filepath.Join(a, "foo"))
+
+	var buf bytes.Buffer
+	if err := (&Manifest{ Root: a, Paths: []string{ "foo" } }).Create(ctx, &buf); err != nil {
+		t.Fatalf("unable to create tarball: %v", err)
+	}
+
+	b := filepath.Join(tmp, "b")
+	foo := PopulateFile(t, filepath.Join(b, "foo"))
+
+	var undo bytes.Buffer
+	m := &Manifest {
+		Root: b,
+		Paths: []string{ "foo" },
+		Hooks: []Hook{ Must(ParseHook("validate foo false")) },
+		Undo: &undo,
+	}
+	if err := m.Extract(ctx, &buf); err == nil {
+		t.Fatalf("unexpected success")
+	}
+
+	CheckFile(t, filepath.Join(b, "foo"), foo)
+	if undo.Len() != 0 {
+		t.Errorf("undo written after rolling back: %d bytes", undo.Len())
+	}
+}
+
+func TestParseHook(t *testing.T) {
+	h := Must(ParseHook("post etc/nginx/** nginx -t && systemctl reload nginx"))
+	if h.Phase != HookPost || h.Pattern != "etc/nginx/**" || h.Command != "nginx -t && systemctl reload nginx" {
+		t.Errorf("unexpected hook: %+v", h)
+	}
+
+	for _, s := range []string{ "post foo", "reload foo bar", "pre" } {
+		if _, err := ParseHook(s); err == nil {
+			t.Errorf("unexpected success: %s", s)
+		}
+	}
+}
+
+func TestReproducible(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	_ = PopulateFile(t, filepath.Join(tmp, "foo"))
+	_ = PopulateFile(t, filepath.Join(tmp, "dir", "bar"))
+	_ = PopulateFile(t, filepath.Join(tmp, "dir", "baz"))
+
+	create := func(paths []string, mtime time.Time) []byte {
+		for _, p := range []string{ "foo", "dir", "dir/bar", "dir/baz" } {
+			Must0(os.Chtimes(filepath.Join(tmp, p), mtime, mtime))
+		}
+
+		m := &Manifest {
+			Root: tmp,
+			Paths: paths,
+			Reproducible: &Reproducible {
+				ModTime: time.Unix(1700000000, 0),
+				NormalizeOwner: true,
+			},
+		}
+
+		var buf bytes.Buffer
+		if err := m.Create(ctx, &buf); err != nil {
+			t.Fatalf("unable to create tarball: %v", err)
+		}
+
+		var cmp bytes.Buffer
+		w := Must(gzip.NewWriterLevel(&cmp, gzip.BestCompression))
+		_ = Must(w.Write(buf.Bytes()))
+		Must0(w.Close())
+
+		return cmp.Bytes()
+	}
+
+	bs0 := create([]string{ "foo", "dir/**" }, time.Now())
+	time.Sleep(10*time.Millisecond)
+	bs1 := create([]string{ "dir/**", "foo" }, time.Now().Add(-time.Hour))
+
+	if !bytes.Equal(bs0, bs1) {
+		t.Errorf("tarballs differ")
+	}
+
+	r := Must(gzip.NewReader(bytes.NewReader(bs0)))
+	names, _ := TarballNames(t, Must(io.ReadAll(r)))
+	if !reflect.DeepEqual(names, []string{ "dir", "dir/bar", "dir/baz", "foo" }) {
+		t.Errorf("unexpected order: %v", names)
+	}
+}
+
+func TestTimes(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	a := filepath.Join(tmp, "a")
+	_ = PopulateFile(t, filepath.Join(a, "dir", "foo"))
+	Must0(os.Symlink("foo", filepath.Join(a, "dir", "bar")))
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 600000000, time.UTC)
+	atime := mtime.Add(time.Hour)
+	Must0(os.Chtimes(filepath.Join(a, "dir", "foo"), atime, mtime))
+	Must0(lutimes(filepath.Join(a, "dir", "bar"), atime, mtime))
+	Must0(os.Chtimes(filepath.Join(a, "dir"), atime, mtime))
+
+	m0 := &Manifest {
+		Root: a,
+		Paths: []string{ "dir/**" },
+		Symlinks: true,
+		AccessTimes: true,
+	}
+
+	var buf bytes.Buffer
+	if err := m0.Create(ctx, &buf); err != nil {
+		t.Fatalf("unable to create tarball: %v", err)
+	}
+
+	b := filepath.Join(tmp, "b")
+	Must0(os.Mkdir(b, 0755))
+
+	m1 := &Manifest {
+		Root: b,
+		Paths: m0.Paths,
+	}
+	if err := m1.Extract(ctx, &buf); err != nil {
+		t.Fatalf("unable to extract tarball: %v", err)
+	}
+
+	if target := Must(os.Readlink(filepath.Join(b, "dir", "bar"))); target != "foo" {
+		t.Errorf("unexpected symlink target: %s", target)
+	}
+
+	for _, p := range []string{ "dir", "dir/foo", "dir/bar" } {
+		fi := Must(os.Lstat(filepath.Join(b, p)))
+		if !fi.ModTime().Equal(mtime) {
+			t.Errorf("unexpected mtime: %s: %v != %v", p, fi.ModTime(), mtime)
+		}
+
+	}
+
+	// the atimes of directories and symlinks are bumped when creating (by
+	// ReadDir respectively Readlink) so only the file's is checked
+	st := Must(os.Stat(filepath.Join(b, "dir", "foo"))).Sys().(*syscall.Stat_t)
+	if at := time.Unix(st.Atim.Unix()); !at.Equal(atime) {
+		t.Errorf("unexpected atime: %v != %v", at, atime)
+	}
+}
+
+func TestNoDirTimes(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	a := filepath.Join(tmp, "a")
+	_ = PopulateFile(t, filepath.Join(a, "dir", "foo"))
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	Must0(os.Chtimes(filepath.Join(a, "dir"), mtime, mtime))
+
+	m0 := &Manifest {
+		Root: a,
+		Paths: []string{ "dir", "dir/foo" },
+	}
+
+	var buf bytes.Buffer
+	if err := m0.Create(ctx, &buf); err != nil {
+		t.Fatalf("unable to create tarball: %v", err)
+	}
+
+	b := filepath.Join(tmp, "b")
+	Must0(os.Mkdir(b, 0755))
+
+	m1 := &Manifest {
+		Root: b,
+		Paths: m0.Paths,
+		NoDirTimes: true,
+	}
+	if err := m1.Extract(ctx, &buf); err != nil {
+		t.Fatalf("unable to extract tarball: %v", err)
+	}
+
+	if fi := Must(os.Stat(filepath.Join(b, "dir"))); fi.ModTime().Equal(mtime) {
+		t.Errorf("directory time restored")
+	}
+}
+
+func TestXattrs(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	a := filepath.Join(tmp, "a")
+	_ = PopulateFile(t, filepath.Join(a, "foo"))
+
+	err := syscall.Setxattr(filepath.Join(a, "foo"), "user.foo", []byte("bar"), 0)
+	if errors.Is(err, syscall.ENOTSUP) {
+		t.Skipf("extended attributes not supported: %v", err)
+	}
+	Must0(err)
+	Must0(syscall.Setxattr(filepath.Join(a, "foo"), "user.baz", []byte("qux"), 0))
+
+	x := &Xattrs {
+		Include: DefaultXattrIncludes,
+		Exclude: []string{ "user.baz" },
+	}
+
+	m0 := &Manifest {
+		Root: a,
+		Paths: []string{ "foo" },
+		Xattrs: x,
+	}
+
+	var buf bytes.Buffer
+	if err := m0.Create(ctx, &buf); err != nil {
+		t.Fatalf("unable to create tarball: %v", err)
+	}
+
+	b := filepath.Join(tmp, "b")
+	Must0(os.Mkdir(b, 0755))
+
+	m1 := &Manifest {
+		Root: b,
+		Paths: m0.Paths,
+		Xattrs: x,
+	}
+	if err := m1.Extract(ctx, &buf); err != nil {
+		t.Fatalf("unable to extract tarball: %v", err)
+	}
+
+	if v := Must(getxattr(filepath.Join(b, "foo"), "user.foo")); string(v) != "bar" {
+		t.Errorf("unexpected xattr value: %q", v)
+	}
+
+	if _, err := getxattr(filepath.Join(b, "foo"), "user.baz"); !errors.Is(err, syscall.ENODATA) {
+		t.Errorf("excluded xattr restored: %v", err)
+	}
+}
+
+// MountTmpfs mounts a tmpfs (supporting security.* extended attributes
+// regardless of the filesystem of the temporary directory), skipping the test
+// when not privileged
+func MountTmpfs(t *testing.T) string {
+	dir := t.TempDir()
+	err := syscall.Mount("tmpfs", dir, "tmpfs", 0, "size=16m")
+	if errors.Is(err, syscall.EPERM) {
+		t.Skipf("unable to mount tmpfs: %v", err)
+	}
+	Must0(err)
+	t.Cleanup(func() {
+		Must0(syscall.Unmount(dir, 0))
+	})
+	return dir
+}
+
+func TestCapabilities(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := MountTmpfs(t)
+	a := filepath.Join(tmp, "a")
+	_ = PopulateFile(t, filepath.Join(a, "foo"))
+	Must0(os.Chmod(filepath.Join(a, "foo"), 0755))
+
+	// vfs_cap_data (revision 2): cap_net_bind_service=ep
+	capability := make([]byte, 20)
+	binary.LittleEndian.PutUint32(capability[0:], 0x02000000 | 0x1)
+	binary.LittleEndian.PutUint32(capability[4:], 1 << 10)
+
+	err := syscall.Setxattr(filepath.Join(a, "foo"), "security.capability", capability, 0)
+	if errors.Is(err, syscall.EPERM) {
+		t.Skipf("unable to set capabilities: %v", err)
+	}
+	Must0(err)
+
+	m0 := &Manifest {
+		Root: a,
+		Paths: []string{ "foo" },
+		Xattrs: &Xattrs{ Include: DefaultXattrIncludes },
+	}
+
+	var buf bytes.Buffer
+	if err := m0.Create(ctx, &buf); err != nil {
+		t.Fatalf("unable to create tarball: %v", err)
+	}
+
+	b := filepath.Join(tmp, "b")
+	Must0(os.Mkdir(b, 0755))
+
+	m1 := &Manifest {
+		Root: b,
+		Paths: m0.Paths,
+		Xattrs: m0.Xattrs,
+	}
+	if err := m1.Extract(ctx, &buf); err != nil {
+		t.Fatalf("unable to extract tarball: %v", err)
+	}
+
+	if v := Must(getxattr(filepath.Join(b, "foo"), "security.capability")); !bytes.Equal(v, capability) {
+		t.Errorf("unexpected capabilities: %x != %x", v, capability)
+	}
+}
+
+func TestHardLinks(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	a := filepath.Join(tmp, "a")
+	foo := PopulateFile(t, filepath.Join(a, "foo"))
+	Must0(os.Link(filepath.Join(a, "foo"), filepath.Join(a, "bar")))
+
+	m0 := &Manifest {
+		Root: a,
+		Paths: []string{ "foo", "bar" },
+	}
+
+	var buf bytes.Buffer
+	if err := m0.Create(ctx, &buf); err != nil {
+		t.Fatalf("unable to create tarball: %v", err)
+	}
+	bs := buf.Bytes()
+
+	tr := tar.NewReader(bytes.NewReader(bs))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		Must0(err)
+		if hdr.Name == "bar" && (hdr.Typeflag != tar.TypeLink || hdr.Linkname != "foo") {
+			t.Errorf("not a hard link: %+v", hdr)
+		}
+	}
+
+	b := filepath.Join(tmp, "b")
+	Must0(os.Mkdir(b, 0755))
+	_ = PopulateFile(t, filepath.Join(b, "bar"))
+
+	m1 := &Manifest {
+		Root: b,
+		Paths: m0.Paths,
+	}
+	if err := m1.Extract(ctx, bytes.NewReader(bs)); err != nil {
+		t.Fatalf("unable to extract tarball: %v", err)
+	}
+
+	CheckFile(t, filepath.Join(b, "bar"), foo)
+	if !os.SameFile(Must(os.Stat(filepath.Join(b, "foo"))), Must(os.Stat(filepath.Join(b, "bar")))) {
+		t.Errorf("not linked")
+	}
+
+	m2 := &Manifest {
+		Root: filepath.Join(tmp, "c"),
+		Paths: []string{ "bar" },
+	}
+	Must0(os.Mkdir(m2.Root, 0755))
+	if err := m2.Extract(ctx, bytes.NewReader(bs)); err == nil {
+		t.Errorf("unexpected success extracting link without its target")
+	}
+}
+
+func TestSpecialFiles(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	a := filepath.Join(tmp, "a")
+	Must0(os.Mkdir(a, 0755))
+	Must0(syscall.Mkfifo(filepath.Join(a, "fifo"), 0640))
+
+	paths := []string{ "fifo" }
+	err := syscall.Mknod(filepath.Join(a, "null"), syscall.S_IFCHR | 0666, mkdev(1, 3))
+	if err == nil {
+		paths = append(paths, "null")
+	} else {
+		t.Logf("unable to create device node: %v", err)
+	}
+
+	l := Must(net.Listen("unix", filepath.Join(a, "sock")))
+	defer l.Close()
+
+	m0 := &Manifest {
+		Root: a,
+		Paths: append(paths, "sock"),
+	}
+	var buf bytes.Buffer
+	if err := m0.Create(ctx, &buf); err != nil {
+		t.Fatalf("unable to create tarball: %v", err)
+	}
+
+	names, _ := TarballNames(t, buf.Bytes())
+	if !reflect.DeepEqual(names, paths) {
+		t.Errorf("unexpected entries: %v", names)
+	}
+
+	b := filepath.Join(tmp, "b")
+	Must0(os.Mkdir(b, 0755))
+
+	// the skipped socket is not required
+	m1 := &Manifest {
+		Root: b,
+		Paths: m0.Paths,
+	}
+	if err := m1.Extract(ctx, bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("unable to extract tarball: %v", err)
+	}
+
+	if fi := Must(os.Lstat(filepath.Join(b, "fifo"))); fi.Mode() != os.ModeNamedPipe | 0640 {
+		t.Errorf("unexpected mode: %v", fi.Mode())
+	}
+
+	if len(paths) > 1 {
+		fi := Must(os.Lstat(filepath.Join(b, "null")))
+		if fi.Mode().Type() != os.ModeDevice | os.ModeCharDevice {
+			t.Errorf("unexpected mode: %v", fi.Mode())
+		}
+		if rdev := fi.Sys().(*syscall.Stat_t).Rdev; rdev != uint64(mkdev(1, 3)) {
+			t.Errorf("unexpected device: %x", rdev)
+		}
+	}
+
+	if _, err := os.Lstat(filepath.Join(b, "sock")); !os.IsNotExist(err) {
+		t.Errorf("socket extracted: %v", err)
+	}
+
+	var skipped bytes.Buffer
+	if err := (&Manifest{ Root: a, Paths: m0.Paths, Special: SpecialSkip }).Create(ctx, &skipped); err != nil {
+		t.Fatalf("unable to create tarball: %v", err)
+	}
+	if names, _ := TarballNames(t, skipped.Bytes()); len(names) != 0 {
+		t.Errorf("unexpected entries: %v", names)
+	}
+	if err := m1.Extract(ctx, &skipped); err != nil {
+		t.Errorf("unable to extract tarball: %v", err)
+	}
+
+	m2 := &Manifest {
+		Root: a,
+		Paths: m0.Paths,
+		Special: SpecialError,
+	}
+	if err := m2.Create(ctx, io.Discard); err == nil {
+		t.Errorf("unexpected success")
+	}
+}
+
+func TestSparse(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	a := filepath.Join(tmp, "a")
+	Must0(os.Mkdir(a, 0755))
+
+	size := int64(4 << 20)
+	f := Must(os.Create(filepath.Join(a, "foo")))
+	Must0(f.Truncate(size))
+	for _, off := range []int64{ 1 << 20, 2 << 20 + 3 } {
+		bs := make([]byte, 8192)
+		_ = Must(prng.Read(bs))
+		_ = Must(f.WriteAt(bs, off))
+	}
+	Must0(f.Close())
+
+	segs := Must(dataSegments(Must(os.Open(filepath.Join(a, "foo"))), size))
+	if !isSparse(segs, size) {
+		t.Skipf("filesystem doesn't support sparse files")
+	}
+
+	m0 := &Manifest {
+		Root: a,
+		Paths: []string{ "foo" },
+	}
+
+	var buf bytes.Buffer
+	if err := m0.Create(ctx, &buf); err != nil {
+		t.Fatalf("unable to create tarball: %v", err)
+	}
+
+	if buf.Len() > 1 << 16 {
+		t.Errorf("tarball not sparse: %d bytes", buf.Len())
+	}
+
+	b := filepath.Join(tmp, "b")
+	Must0(os.Mkdir(b, 0755))
+
+	m1 := &Manifest {
+		Root: b,
+		Paths: m0.Paths,
+	}
+	if err := m1.Extract(ctx, &buf); err != nil {
+		t.Fatalf("unable to extract tarball: %v", err)
+	}
+
+	if !bytes.Equal(Must(os.ReadFile(filepath.Join(a, "foo"))), Must(os.ReadFile(filepath.Join(b, "foo")))) {
+		t.Errorf("content mismatch")
+	}
+
+	fi := Must(os.Stat(filepath.Join(b, "foo")))
+	if fi.Size() != size {
+		t.Errorf("unexpected size: %d != %d", fi.Size(), size)
+	}
+	if allocated := fi.Sys().(*syscall.Stat_t).Blocks * 512; allocated >= size {
+		t.Errorf("extracted file not sparse: %d bytes allocated", allocated)
+	}
+}
+
+func Tarball(t *testing.T, hdrs ...*tar.Header) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range hdrs {
+		Must0(tw.WriteHeader(hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			_ = Must(tw.Write(make([]byte, hdr.Size)))
+		}
+	}
+	Must0(tw.Close())
+	return buf.Bytes()
+}
+
+func TestOwnerMapsAndOverrides(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	if os.Getuid() != 0 {
+		t.Skipf("not privileged")
+	}
+
+	bs := Tarball(t,
+		&tar.Header{ Typeflag: tar.TypeReg, Name: "foo", Mode: 0644, Uid: 1234, Gid: 1234, Uname: "nosuchuser", Gname: "nosuchgroup" },
+		&tar.Header{ Typeflag: tar.TypeReg, Name: "bar", Mode: 0644, Uid: 1234, Gid: 1234, Uname: "nosuchuser", Gname: "nosuchgroup" },
+	)
+
+	tmp := t.TempDir()
+	manifest := filepath.Join(tmp, "manifest")
+	Must0(os.WriteFile(manifest, []byte("foo\nbar owner=3456 group=5678 mode=0600\n"), 0644))
+
+	root := filepath.Join(tmp, "root")
+	Must0(os.Mkdir(root, 0755))
+
+	m := Must(Load(ctx, manifest, root))
+	m.OwnerMap = Must(ParseIdMap("1234:2345"))
+	m.GroupMap = Must(ParseIdMap("nosuchgroup:4321"))
+
+	if err := m.Extract(ctx, bytes.NewReader(bs)); err != nil {
+		t.Fatalf("unable to extract tarball: %v", err)
+	}
+
+	for _, c := range []struct{ name string; uid, gid int; mode os.FileMode }{
+		{ "foo", 2345, 4321, 0644 },
+		{ "bar", 3456, 5678, 0600 },
+	} {
+		path := filepath.Join(root, c.name)
+		uid, gid, err := FileUidGid(path)
+		Must0(err)
+		if uid != c.uid || gid != c.gid {
+			t.Errorf("unexpected owner of %s: %d:%d != %d:%d", c.name, uid, gid, c.uid, c.gid)
+		}
+		if mode := Must(FileMode(path)); mode != c.mode {
+			t.Errorf("unexpected mode of %s: %v != %v", c.name, mode, c.mode)
+		}
+	}
+}
+
+func TestGroupLookupByGname(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	if os.Getuid() != 0 {
+		t.Skipf("not privileged")
+	}
+
+	g, err := user.LookupGroupId("1")
+	if err != nil {
+		t.Skipf("no group with gid 1: %v", err)
+	}
+
+	bs := Tarball(t, &tar.Header{ Typeflag: tar.TypeReg, Name: "foo", Mode: 0644, Uname: "root", Gname: g.Name, Gid: 4242 })
+
+	m := &Manifest {
+		Root: t.TempDir(),
+		Paths: []string{ "foo" },
+	}
+	if err := m.Extract(ctx, bytes.NewReader(bs)); err != nil {
+		t.Fatalf("unable to extract tarball: %v", err)
+	}
+
+	_, gid, err := FileUidGid(filepath.Join(m.Root, "foo"))
+	Must0(err)
+	if gid != 1 {
+		t.Errorf("unexpected gid: %d", gid)
+	}
+
+	m.NumericOwner = true
+	if err := m.Extract(ctx, bytes.NewReader(bs)); err != nil {
+		t.Fatalf("unable to extract tarball: %v", err)
+	}
+
+	_, gid, err = FileUidGid(filepath.Join(m.Root, "foo"))
+	Must0(err)
+	if gid != 4242 {
+		t.Errorf("unexpected gid: %d", gid)
+	}
+}
+
+func TestNoSameOwner(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	bs := Tarball(t, &tar.Header{ Typeflag: tar.TypeReg, Name: "foo", Mode: 0644, Uid: 1234, Gid: 1234 })
+
+	m := &Manifest {
+		Root: t.TempDir(),
+		Paths: []string{ "foo" },
+		NoSameOwner: true,
+	}
+	if err := m.Extract(ctx, bytes.NewReader(bs)); err != nil {
+		t.Fatalf("unable to extract tarball: %v", err)
+	}
+
+	uid, gid, err := FileUidGid(filepath.Join(m.Root, "foo"))
+	Must0(err)
+	if uid != os.Getuid() || gid != os.Getgid() {
+		t.Errorf("unexpected owner: %d:%d", uid, gid)
+	}
+}
+
+func TestParseIdMapFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "map")
+	Must0(os.WriteFile(path, []byte("# comment\nfoo:bar\n\n1000:1001\n"), 0644))
+
+	m := Must(ParseIdMap("@" + path))
+	if !reflect.DeepEqual(m, IdMap{ "foo": "bar", "1000": "1001" }) {
+		t.Errorf("unexpected map: %v", m)
+	}
+
+	if _, err := ParseIdMap("foo"); err == nil {
+		t.Errorf("unexpected success")
+	}
+}
+
+func TestLoadAttributes(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	path := filepath.Join(tmp, "manifest")
+	Must0(os.WriteFile(path, []byte(`# comment
+foo
+  "with spaces" mode=0600 # trailing comment
+with\ escapes optional
+dir recursive noreplace
+!dir/cache/**
+
+hook post foo true
+`), 0644))
+
+	m := Must(Load(ctx, path, tmp))
+
+	if !reflect.DeepEqual(m.Paths, []string{ "foo", "with spaces", "with escapes", "dir/**" }) {
+		t.Errorf("unexpected paths: %q", m.Paths)
+	}
+	if !reflect.DeepEqual(m.Excludes, []string{ "dir/cache/**" }) {
+		t.Errorf("unexpected excludes: %q", m.Excludes)
+	}
+	if !reflect.DeepEqual(m.Optional, map[string]bool{ "with escapes": true }) {
+		t.Errorf("unexpected optional: %v", m.Optional)
+	}
+	if !reflect.DeepEqual(m.NoReplace, []string{ "dir/**" }) {
+		t.Errorf("unexpected noreplace: %v", m.NoReplace)
+	}
+	if len(m.Overrides) != 1 || m.Overrides[0].Path != "with spaces" || *m.Overrides[0].Mode != 0600 {
+		t.Errorf("unexpected overrides: %+v", m.Overrides)
+	}
+	if len(m.Hooks) != 1 {
+		t.Errorf("unexpected hooks: %+v", m.Hooks)
+	}
+}
+
+func TestLoadBarePaths(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	path := filepath.Join(tmp, "manifest")
+	Must0(os.WriteFile(path, []byte(`with spaces
+notes #1
+back\slash
+say "hello"
+unterminated "quote
+file optional
+`), 0644))
+
+	m := Must(Load(ctx, path, tmp))
+
+	if !reflect.DeepEqual(m.Paths, []string{ "with spaces", "notes #1", `back\slash`, `say "hello"`, `unterminated "quote`, "file" }) {
+		t.Errorf("unexpected paths: %q", m.Paths)
+	}
+	if !reflect.DeepEqual(m.Optional, map[string]bool{ "file": true }) {
+		t.Errorf("unexpected optional: %v", m.Optional)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	path := filepath.Join(t.TempDir(), "manifest")
+	for _, c := range []struct{ content, err string }{
+		{ "foo\n\"bar\" baz\n", path + ":2: unknown attribute: baz" },
+		{ "foo mode=999\n", path + ":1: invalid mode: 999" },
+		{ "foo owner=\n", path + ":1: empty attribute: owner=" },
+		{ "\n\n\"foo\n", path + ":3: unterminated quote" },
+		{ "!foo optional\n", path + ":1: attributes on exclude: foo" },
+	} {
+		Must0(os.WriteFile(path, []byte(c.content), 0644))
+		if _, err := Load(ctx, path, "/"); err == nil || err.Error() != c.err {
+			t.Errorf("unexpected error: %v != %s", err, c.err)
+		}
+	}
+}
+
+func TestOptionalAndNoReplace(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	a := filepath.Join(tmp, "a")
+	_ = PopulateFile(t, filepath.Join(a, "foo"))
+	_ = PopulateFile(t, filepath.Join(a, "bar"))
+
+	manifest := filepath.Join(tmp, "manifest")
+	Must0(os.WriteFile(manifest, []byte("foo noreplace\nbar\nbaz optional\n"), 0644))
+
+	var buf bytes.Buffer
+	if err := Must(Load(ctx, manifest, a)).Create(ctx, &buf); err != nil {
+		t.Fatalf("unable to create tarball: %v", err)
+	}
+
+	b := filepath.Join(tmp, "b")
+	foo := PopulateFile(t, filepath.Join(b, "foo"))
+	if err := Must(Load(ctx, manifest, b)).Extract(ctx, &buf); err != nil {
+		t.Fatalf("unable to extract tarball: %v", err)
+	}
+
+	CheckFile(t, filepath.Join(b, "foo"), foo)
+	if _, err := os.Stat(filepath.Join(b, "bar")); err != nil {
+		t.Errorf("not extracted: %v", err)
+	}
+}
+
+func TestLoadStructured(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	docs := map[string]string {
+		"package.json": `{
+  "root": "root",
+  "destination": "s3://bucket/app.tar.gz",
+  "gzip": 9,
+  "owner": "root",
+  "hooks": [ { "phase": "pre", "command": "true" } ],
+  "groups": {
+    "nginx": {
+      "paths": [ "etc/nginx" ],
+      "recursive": true,
+      "excludes": [ "etc/nginx/*.bak" ],
+      "mode": "0640",
+      "hooks": [ { "phase": "post", "command": "nginx -t" } ]
+    },
+    "app": { "paths": [ "bin/app" ], "optional": true }
+  }
+}`,
+		"package.yaml": `root: root
+destination: s3://bucket/app.tar.gz
+gzip: 9
+owner: root
+hooks:
+  - phase: pre
+    command: "true"
+groups:
+  nginx:
+    paths: [ etc/nginx ]
+    recursive: true
+    excludes: [ "etc/nginx/*.bak" ]
+    mode: "0640"
+    hooks:
+      - phase: post
+        command: nginx -t
+  app:
+    paths: [ bin/app ]
+    optional: true
+`,
+		"package.toml": `root = "root"
+destination = "s3://bucket/app.tar.gz"
+gzip = 9
+owner = "root"
+
+[[hooks]]
+phase = "pre"
+command = "true"
+
+[groups.nginx]
+paths = [ "etc/nginx" ]
+recursive = true
+excludes = [ "etc/nginx/*.bak" ]
+mode = "0640"
+
+[[groups.nginx.hooks]]
+phase = "post"
+command = "nginx -t"
+
+[groups.app]
+paths = [ "bin/app" ]
+optional = true
+`,
+	}
+
+	for n, doc := range docs {
+		path := filepath.Join(tmp, n)
+		Must0(os.WriteFile(path, []byte(doc), 0644))
+
+		m := Must(Load(ctx, path, "/"))
+
+		if m.Root != filepath.Join(tmp, "root") {
+			t.Errorf("%s: unexpected root: %s", n, m.Root)
+		}
+		if m.Package == nil || m.Package.Destination != "s3://bucket/app.tar.gz" || m.Package.Gzip == nil || *m.Package.Gzip != 9 {
+			t.Errorf("%s: unexpected package: %+v", n, m.Package)
+		}
+		if !reflect.DeepEqual(m.Paths, []string{ "bin/app", "etc/nginx/**" }) {
+			t.Errorf("%s: unexpected paths: %q", n, m.Paths)
+		}
+		if !reflect.DeepEqual(m.Excludes, []string{ "etc/nginx/*.bak" }) {
+			t.Errorf("%s: unexpected excludes: %q", n, m.Excludes)
+		}
+		if !reflect.DeepEqual(m.Optional, map[string]bool{ "bin/app": true }) {
+			t.Errorf("%s: unexpected optional: %v", n, m.Optional)
+		}
+		if len(m.Overrides) != 2 {
+			t.Fatalf("%s: unexpected overrides: %+v", n, m.Overrides)
+		}
+		if o := m.Overrides[1]; o.Path != "etc/nginx/**" || o.Owner != "root" || *o.Mode != 0640 {
+			t.Errorf("%s: unexpected override: %+v", n, o)
+		}
+		if len(m.Hooks) != 2 || m.Hooks[0].Phase != HookPre || !reflect.DeepEqual(m.Hooks[1].Patterns, []string{ "etc/nginx/**" }) {
+			t.Errorf("%s: unexpected hooks: %+v", n, m.Hooks)
+		}
+	}
+}
+
+func TestLoadStructuredUnknownField(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	for n, doc := range map[string]string {
+		"package.json": `{ "grups": {} }`,
+		"package.yaml": "grups: {}\n",
+		"package.toml": "[grups]\n",
+	} {
+		path := filepath.Join(tmp, n)
+		Must0(os.WriteFile(path, []byte(doc), 0644))
+		if _, err := Load(ctx, path, "/"); err == nil {
+			t.Errorf("%s: unknown field accepted", n)
+		}
+	}
+}
+
+func TestLoadIncludes(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	Must0(os.MkdirAll(filepath.Join(tmp, "roles"), 0755))
+	for n, content := range map[string]string {
+		"manifest": "include common.manifest roles/*.manifest\netc/site.conf\n",
+		"common.manifest": "etc/hosts\n!etc/**/*.bak\nhook post etc/** true\n",
+		"roles/nginx.manifest": "include ../common.manifest\netc/nginx recursive\n",
+		"roles/app.manifest": "etc/hosts\nbin/app\n",
+	} {
+		Must0(os.WriteFile(filepath.Join(tmp, n), []byte(content), 0644))
+	}
+
+	m := Must(Load(ctx, filepath.Join(tmp, "manifest"), tmp))
+
+	if !reflect.DeepEqual(m.Paths, []string{ "etc/hosts", "bin/app", "etc/nginx/**", "etc/site.conf" }) {
+		t.Errorf("unexpected paths: %q", m.Paths)
+	}
+	if !reflect.DeepEqual(m.Excludes, []string{ "etc/**/*.bak" }) {
+		t.Errorf("unexpected excludes: %q", m.Excludes)
+	}
+	if len(m.Hooks) != 1 {
+		t.Errorf("unexpected hooks: %+v", m.Hooks)
+	}
+
+	var b bytes.Buffer
+	Must0(m.Explain(&b))
+	common, roles := filepath.Join(tmp, "common.manifest"), filepath.Join(tmp, "roles")
+	expected := fmt.Sprintf(`etc/hosts	%[1]s:1, %[2]s/app.manifest:1
+bin/app	%[2]s/app.manifest:2
+etc/nginx/**	%[2]s/nginx.manifest:2
+etc/site.conf	%[3]s:2
+!etc/**/*.bak	%[1]s:2
+`, common, roles, filepath.Join(tmp, "manifest"))
+	if b.String() != expected {
+		t.Errorf("unexpected explanation:\n%s", b.String())
+	}
+}
+
+func TestLoadIncludeCycle(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	a, b := filepath.Join(tmp, "a.manifest"), filepath.Join(tmp, "b.manifest")
+	Must0(os.WriteFile(a, []byte("foo\ninclude b.manifest\n"), 0644))
+	Must0(os.WriteFile(b, []byte("include a.manifest\n"), 0644))
+
+	expected := fmt.Sprintf("%[1]s:2: %[2]s:1: include cycle: %[1]s -> %[2]s -> %[1]s", a, b)
+	if _, err := Load(ctx, a, tmp); err == nil || err.Error() != expected {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestLoadVars(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+	t.Setenv("SITEPKG_TEST_ENV", "prod")
+	t.Setenv("SITEPKG_TEST_USER", "app")
+
+	tmp := t.TempDir()
+	path := filepath.Join(tmp, "manifest")
+	Must0(os.WriteFile(path, []byte(`etc/myapp-${SITEPKG_TEST_ENV}/app.conf owner=$SITEPKG_TEST_USER
+price$$
+hook post etc/myapp-${SITEPKG_TEST_ENV}/** true
+`), 0644))
+
+	vars := &Vars{}
+	Must0(vars.Parse("SITEPKG_TEST_ENV=staging"))
+	m := Must(LoadVars(ctx, path, tmp, vars))
+
+	if !reflect.DeepEqual(m.Paths, []string{ "etc/myapp-staging/app.conf", "price$" }) {
+		t.Errorf("unexpected paths: %q", m.Paths)
+	}
+	if len(m.Overrides) != 1 || m.Overrides[0].Owner != "app" {
+		t.Errorf("unexpected overrides: %+v", m.Overrides)
+	}
+	if len(m.Hooks) != 1 || m.Hooks[0].Pattern != "etc/myapp-staging/**" {
+		t.Errorf("unexpected hooks: %+v", m.Hooks)
+	}
+
+	Must0(os.WriteFile(path, []byte("foo\n/home/${SITEPKG_TEST_UNDEFINED}/bar\n\"$SITEPKG_TEST_ENV\"\n\\$SITEPKG_TEST_ENV/x\n"), 0644))
+	if m := Must(Load(ctx, path, tmp)); !reflect.DeepEqual(m.Paths, []string{ "foo", "/home/${SITEPKG_TEST_UNDEFINED}/bar", "$SITEPKG_TEST_ENV", `\$SITEPKG_TEST_ENV/x` }) {
+		t.Errorf("expanded without vars: %q", m.Paths)
+	}
+	if m := Must(LoadVars(ctx, path, tmp, &Vars{})); !reflect.DeepEqual(m.Paths, []string{ "foo", "/home//bar", "$SITEPKG_TEST_ENV", "$SITEPKG_TEST_ENV/x" }) {
+		t.Errorf("unexpected paths: %q", m.Paths)
+	}
+	expected := path + ":2: undefined variable: SITEPKG_TEST_UNDEFINED"
+	if _, err := LoadVars(ctx, path, tmp, &Vars{ Strict: true }); err == nil || err.Error() != expected {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	a := filepath.Join(tmp, "a")
+	Must0(os.MkdirAll(a, 0755))
+	tmpl := []byte("{{ .Hostname }} {{ .Vars.ENV }}\n")
+	Must0(os.WriteFile(filepath.Join(a, "app.conf"), tmpl, 0644))
+	Must0(os.WriteFile(filepath.Join(a, "raw.conf"), tmpl, 0644))
+
+	manifest := filepath.Join(tmp, "manifest")
+	Must0(os.WriteFile(manifest, []byte("app.conf template\nraw.conf\n"), 0644))
+
+	var buf bytes.Buffer
+	if err := Must(Load(ctx, manifest, a)).Create(ctx, &buf); err != nil {
+		t.Fatalf("unable to create tarball: %v", err)
+	}
+	bs := buf.Bytes()
+
+	b := filepath.Join(tmp, "b")
+	Must0(os.MkdirAll(b, 0755))
+	vars := &Vars{}
+	Must0(vars.Parse("ENV=prod"))
+	if err := Must(LoadVars(ctx, manifest, b, vars)).Extract(ctx, bytes.NewReader(bs)); err != nil {
+		t.Fatalf("unable to extract tarball: %v", err)
+	}
+
+	CheckFile(t, filepath.Join(b, "app.conf"), []byte(Must(os.Hostname()) + " prod\n"))
+	CheckFile(t, filepath.Join(b, "raw.conf"), tmpl)
+
+	if err := Must(Load(ctx, manifest, b)).Extract(ctx, bytes.NewReader(bs)); err == nil {
+		t.Errorf("rendered template with undefined variable")
+	}
+
+	// rendered as marked in the package, also without a manifest
+	c := filepath.Join(tmp, "c")
+	Must0(os.MkdirAll(c, 0755))
+	m := &Manifest{ Root: c, Paths: []string{ "app.conf", "raw.conf" }, Vars: vars }
+	if err := m.Extract(ctx, bytes.NewReader(bs)); err != nil {
+		t.Fatalf("unable to extract tarball: %v", err)
+	}
+	CheckFile(t, filepath.Join(c, "app.conf"), []byte(Must(os.Hostname()) + " prod\n"))
+	CheckFile(t, filepath.Join(c, "raw.conf"), tmpl)
+}
+
+func TestWhiteoutMarkers(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	foo := PopulateFile(t, filepath.Join(tmp, "dir", "foo"))
+	_ = PopulateFile(t, filepath.Join(tmp, "dir", "bar"))
+
+	m := &Manifest{ Root: tmp, Paths: []string{ "dir/**" } }
+	bs := Tarball(t, whiteout("dir/bar"))
+	if err := m.Extract(ctx, bytes.NewReader(bs)); err != nil {
+		t.Fatalf("unable to extract tarball: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "dir", "bar")); !os.IsNotExist(err) {
+		t.Errorf("whiteout not applied: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "dir", ".wh.bar")); !os.IsNotExist(err) {
+		t.Errorf("whiteout extracted as a file: %v", err)
+	}
+
+	// only entries with the PAX record are whiteouts
+	bs = Tarball(t, &tar.Header{ Typeflag: tar.TypeReg, Name: "dir/.wh.foo", Mode: 0600 })
+	if err := m.Extract(ctx, bytes.NewReader(bs)); err != nil {
+		t.Fatalf("unable to extract tarball: %v", err)
+	}
+	CheckFile(t, filepath.Join(tmp, "dir", "foo"), foo)
+	CheckFile(t, filepath.Join(tmp, "dir", ".wh.foo"), nil)
+
+	hdr := whiteout("dir/foo")
+	hdr.Name = "dir/foo"
+	bs = Tarball(t, hdr)
+	if err := m.Extract(ctx, bytes.NewReader(bs)); err == nil {
+		t.Errorf("invalid whiteout accepted")
+	}
+	CheckFile(t, filepath.Join(tmp, "dir", "foo"), foo)
+}
+
+func TestReservedNames(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	wh := PopulateFile(t, filepath.Join(tmp, "dir", ".wh.foo"))
+
+	var buf bytes.Buffer
+	if err := (&Manifest{ Root: tmp, Paths: []string{ "dir/**" } }).Create(ctx, &buf); err != nil {
+		t.Fatalf("unable to create tarball: %v", err)
+	}
+	if names, whiteouts := TarballNames(t, buf.Bytes()); !slices.Contains(names, "dir/.wh.foo") || len(whiteouts) != 0 {
+		t.Errorf("unexpected entries: %v (whiteouts: %v)", names, whiteouts)
+	}
+
+	b := filepath.Join(tmp, "b")
+	Must0(os.MkdirAll(filepath.Join(b, "dir"), 0755))
+	if err := (&Manifest{ Root: b, Paths: []string{ "dir/**" } }).Extract(ctx, &buf); err != nil {
+		t.Fatalf("unable to extract tarball: %v", err)
+	}
+	CheckFile(t, filepath.Join(b, "dir", ".wh.foo"), wh)
+
+	if err := (&Manifest{ Root: tmp, Paths: []string{ "dir/.wh.foo" } }).Create(ctx, io.Discard); err == nil {
+		t.Errorf("created tarball with reserved name")
+	}
+}
+
+func TestRollbackPartialExtraction(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	a := filepath.Join(tmp, "a")
+	_ = PopulateFile(t, filepath.Join(a, "foo"))
+
+	var buf bytes.Buffer
+	if err := (&Manifest{ Root: a, Paths: []string{ "foo" } }).Create(ctx, &buf); err != nil {
+		t.Fatalf("unable to create tarball: %v", err)
+	}
+
+	b := filepath.Join(tmp, "b")
+	foo := PopulateFile(t, filepath.Join(b, "foo"))
+
+	var undo bytes.Buffer
+	m := &Manifest {
+		Root: b,
+		Paths: []string{ "foo", "missing" },
+		Undo: &undo,
+	}
+	if err := m.Extract(ctx, &buf); err == nil {
+		t.Fatalf("extracted tarball without missing path")
+	}
+
+	if err := Rollback(ctx, b, &undo); err != nil {
+		t.Fatalf("unable to rollback: %v", err)
+	}
+	CheckFile(t, filepath.Join(b, "foo"), foo)
+}
+
+func TestDigestIgnoresTimes(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	foo := filepath.Join(tmp, "foo")
+	_ = PopulateFile(t, foo)
+	m := &Manifest{ Root: tmp, Paths: []string{ "foo" } }
+
+	digest := func() []byte {
+		var buf bytes.Buffer
+		Must0(m.Create(ctx, &buf))
+		return Must(Digest(&buf))
+	}
+
+	d0 := digest()
+	Must0(os.Chtimes(foo, time.Unix(1, 0), time.Unix(2, 0)))
+	if d1 := digest(); !bytes.Equal(d0, d1) {
+		t.Errorf("digest changed with times")
+	}
+
+	_ = PopulateFile(t, foo)
+	Must0(os.WriteFile(foo, append(Must(os.ReadFile(foo)), 'x'), 0644))
+	if d2 := digest(); bytes.Equal(d0, d2) {
+		t.Errorf("digest unchanged with content")
+	}
+}
+
+func TestDeviceNumbersIndexed(t *testing.T) {
+	null := &tar.Header{ Typeflag: tar.TypeChar, Name: "null", Mode: 0666, Devmajor: 1, Devminor: 3 }
+	zero := &tar.Header{ Typeflag: tar.TypeChar, Name: "null", Mode: 0666, Devmajor: 1, Devminor: 5 }
+
+	idx := Must(ReadIndex(bytes.NewReader(Tarball(t, null))))
+	if idx.Unchanged(zero) {
+		t.Errorf("changed device numbers considered unchanged")
+	}
+
+	d0 := Must(Digest(bytes.NewReader(Tarball(t, null))))
+	if d1 := Must(Digest(bytes.NewReader(Tarball(t, zero)))); bytes.Equal(d0, d1) {
+		t.Errorf("digest unchanged with device numbers")
+	}
+}
+
+func TestSymlinksFollowedByDefault(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	a := filepath.Join(tmp, "a")
+	foo := PopulateFile(t, filepath.Join(a, "foo"))
+	Must0(os.Symlink("foo", filepath.Join(a, "bar")))
+
+	var buf bytes.Buffer
+	if err := (&Manifest{ Root: a, Paths: []string{ "bar" } }).Create(ctx, &buf); err != nil {
+		t.Fatalf("unable to create tarball: %v", err)
+	}
+
+	hdr := Must(tar.NewReader(bytes.NewReader(buf.Bytes())).Next())
+	if hdr.Typeflag != tar.TypeReg || !hdr.AccessTime.IsZero() {
+		t.Errorf("unexpected entry: %c (atime %v)", hdr.Typeflag, hdr.AccessTime)
+	}
+
+	b := filepath.Join(tmp, "b")
+	Must0(os.Mkdir(b, 0755))
+	if err := (&Manifest{ Root: b, Paths: []string{ "bar" } }).Extract(ctx, &buf); err != nil {
+		t.Fatalf("unable to extract tarball: %v", err)
+	}
+	CheckFile(t, filepath.Join(b, "bar"), foo)
+}
+
+func TestRefuseExtractThroughSymlink(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	root, outside := filepath.Join(tmp, "root"), filepath.Join(tmp, "outside")
+	Must0(os.Mkdir(root, 0755))
+	Must0(os.Mkdir(outside, 0755))
+
+	m := &Manifest{ Root: root, Paths: []string{ "dir/**" } }
+	bs := Tarball(t,
+		&tar.Header{ Typeflag: tar.TypeDir, Name: "dir", Mode: 0755 },
+		&tar.Header{ Typeflag: tar.TypeSymlink, Name: "dir/link", Linkname: outside, Mode: 0777 },
+		&tar.Header{ Typeflag: tar.TypeReg, Name: "dir/link/x", Mode: 0644 },
+	)
+	if err := m.Extract(ctx, bytes.NewReader(bs)); err == nil {
+		t.Errorf("extracted through symlink")
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "x")); !os.IsNotExist(err) {
+		t.Errorf("extracted outside of root: %v", err)
+	}
+
+	// an existing symlink is replaced, not written through
+	secret := PopulateFile(t, filepath.Join(outside, "secret"))
+	Must0(os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "dir", "file")))
+	bs = Tarball(t, &tar.Header{ Typeflag: tar.TypeReg, Name: "dir/file", Mode: 0644, Size: 1 })
+	if err := m.Extract(ctx, bytes.NewReader(bs)); err != nil {
+		t.Fatalf("unable to extract tarball: %v", err)
+	}
+	CheckFile(t, filepath.Join(outside, "secret"), secret)
+	if fi := Must(os.Lstat(filepath.Join(root, "dir", "file"))); !fi.Mode().IsRegular() {
+		t.Errorf("symlink not replaced: %v", fi.Mode())
+	}
+}
+
+func TestXattrsUnprivileged(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	if path := os.Getenv("SITEPKG_TEST_UNPRIVILEGED"); path != "" {
+		hdr := &tar.Header {
+			Typeflag: tar.TypeReg,
+			PAXRecords: map[string]string {
+				PAXXattrPrefix + "trusted.foo": "bar",
+				PAXXattrPrefix + "user.foo": "bar",
+			},
+		}
+		x := &Xattrs{ Include: []string{ "user.*", "trusted.*" } }
+		if err := x.restore(ctx, path, hdr); err != nil {
+			t.Fatalf("unable to restore extended attributes: %v", err)
+		}
+		if v := Must(getxattr(path, "user.foo")); string(v) != "bar" {
+			t.Errorf("unexpected extended attribute: %s", v)
+		}
+		return
+	}
+
+	if os.Getuid() != 0 {
+		t.Skip("requires root to drop privileges")
+	}
+
+	// accessible to the unprivileged user, as is a copy of the test binary
+	dir := t.TempDir()
+	Must0(os.Chmod(filepath.Dir(dir), 0755))
+	Must0(os.Chmod(dir, 0755))
+	path := filepath.Join(dir, "foo")
+	_ = PopulateFile(t, path)
+	Must0(os.Chown(path, 65534, 65534))
+	bin := filepath.Join(dir, "test")
+	Must0(os.WriteFile(bin, Must(os.ReadFile(os.Args[0])), 0755))
+
+	cmd := exec.Command(bin, "-test.run=^TestXattrsUnprivileged$")
+	cmd.Env = append(os.Environ(), "SITEPKG_TEST_UNPRIVILEGED=" + path)
+	cmd.SysProcAttr = &syscall.SysProcAttr {
+		Credential: &syscall.Credential{ Uid: 65534, Gid: 65534 },
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("unprivileged restore failed: %v\n%s", err, out)
+	}
+}
+
+func TestIncrementalHardLinks(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	a := filepath.Join(tmp, "a")
+	foo := PopulateFile(t, filepath.Join(a, "foo"))
+
+	m := &Manifest {
+		Root: a,
+		Paths: []string{ "foo", "bar" },
+		Optional: map[string]bool{ "foo": true, "bar": true },
+	}
+
+	create := func(base []byte) []byte {
+		var idx Index
+		if base != nil {
+			idx = Must(ReadIndex(bytes.NewReader(base)))
+		}
+		var buf bytes.Buffer
+		Must0(m.CreateIncremental(ctx, &buf, idx))
+		return buf.Bytes()
+	}
+
+	b := filepath.Join(tmp, "b")
+	Must0(os.Mkdir(b, 0755))
+	extract := func(bs []byte) {
+		if err := (&Manifest{ Root: b, Paths: m.Paths, Optional: m.Optional }).Extract(ctx, bytes.NewReader(bs)); err != nil {
+			t.Fatalf("unable to extract tarball: %v", err)
+		}
+	}
+
+	// a link to a target unchanged since the base, extracted without the base
+	base := create(nil)
+	extract(base)
+	Must0(os.Link(filepath.Join(a, "foo"), filepath.Join(a, "bar")))
+	inc := create(base)
+	if names, _ := TarballNames(t, inc); fmt.Sprint(names) != "[bar]" {
+		t.Errorf("unexpected entries: %v", names)
+	}
+	extract(inc)
+	CheckFile(t, filepath.Join(b, "bar"), foo)
+
+	// a link to a changed target
+	base = create(nil)
+	foo = append(foo, 'x')
+	Must0(os.WriteFile(filepath.Join(a, "foo"), foo, 0644))
+	inc = create(base)
+	if names, _ := TarballNames(t, inc); fmt.Sprint(names) != "[foo bar]" {
+		t.Errorf("unexpected entries: %v", names)
+	}
+	extract(inc)
+	CheckFile(t, filepath.Join(b, "bar"), foo)
+
+	// unchanged
+	if names, _ := TarballNames(t, create(create(nil))); len(names) != 0 {
+		t.Errorf("unexpected entries: %v", names)
+	}
+}
+
+func TestNoReplaceChain(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	tmp := t.TempDir()
+	a := filepath.Join(tmp, "a")
+	_ = PopulateFile(t, filepath.Join(a, "foo"))
+	m0 := &Manifest{ Root: a, Paths: []string{ "foo" } }
+
+	var base bytes.Buffer
+	Must0(m0.Create(ctx, &base))
+	foo := PopulateFile(t, filepath.Join(a, "foo"))
+	var inc bytes.Buffer
+	Must0(m0.CreateIncremental(ctx, &inc, Must(ReadIndex(bytes.NewReader(base.Bytes())))))
+
+	b := filepath.Join(tmp, "b")
+	Must0(os.Mkdir(b, 0755))
+	m1 := &Manifest{ Root: b, Paths: m0.Paths, NoReplace: []string{ "foo" } }
+	if err := m1.ExtractChain(ctx, bytes.NewReader(base.Bytes()), bytes.NewReader(inc.Bytes())); err != nil {
+		t.Fatalf("unable to extract tarballs: %v", err)
+	}
+	CheckFile(t, filepath.Join(b, "foo"), foo)
+
+	existing := PopulateFile(t, filepath.Join(b, "foo"))
+	if err := m1.ExtractChain(ctx, bytes.NewReader(base.Bytes()), bytes.NewReader(inc.Bytes())); err != nil {
+		t.Fatalf("unable to extract tarballs: %v", err)
+	}
+	CheckFile(t, filepath.Join(b, "foo"), existing)
+}
+
+func TestLoadStructuredEmptyHookPattern(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	path := filepath.Join(t.TempDir(), "package.yaml")
+	Must0(os.WriteFile(path, []byte("hooks:\n  - phase: post\n    pattern: ${PATTERN}\n    command: \"true\"\n"), 0644))
+
+	vars := &Vars{}
+	Must0(vars.Parse("PATTERN="))
+	if _, err := LoadVars(ctx, path, "/", vars); err == nil {
+		t.Errorf("accepted hook with empty pattern")
+	}
+}
+
+func TestLoadEmptyHookPattern(t *testing.T) {
+	ctx := logging.SetupTestLogger(context.TODO(), t)
+
+	path := filepath.Join(t.TempDir(), "manifest")
+	Must0(os.WriteFile(path, []byte("foo\nhook validate $SITEPKG_TEST_UNDEFINED true\n"), 0644))
+
+	expected := path + ":2: validate hook without pattern"
+	if _, err := LoadVars(ctx, path, "/", &Vars{}); err == nil || err.Error() != expected {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package manifest
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// Paths in a manifest are either exact, glob patterns (see filepath.Match) or
+// recursive (dir/**: the directory and everything below it)
+
+const recursiveSuffix = "/**"
+
+func IsRecursive(p string) bool {
+	return strings.HasSuffix(p, recursiveSuffix)
+}
+
+func IsGlob(p string) bool {
+	return !IsRecursive(p) && strings.ContainsAny(p, "*?[")
+}
+
+func IsExact(p string) bool {
+	return !IsRecursive(p) && !IsGlob(p)
+}
+
+func matches(p, name string) bool {
+	if IsRecursive(p) {
+		base := strings.TrimSuffix(p, recursiveSuffix)
+		return name == base || strings.HasPrefix(name, base + "/")
+	}
+
+	if IsGlob(p) {
+		ok, _ := filepath.Match(p, name)
+		return ok
+	}
+
+	return p == name
+}
+
+func (m *Manifest) Excluded(name string) bool {
+	for _, e := range m.Excludes {
+		if matches(e, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match reports whether the name is covered by the manifest's paths and not excluded
+func (m *Manifest) Match(name string) bool {
+	if m.Excluded(name) {
+		return false
+	}
+
+	for _, p := range m.Paths {
+		if matches(p, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// name converts a resolved path back into a name relative to the root, when
+// the originating manifest path was relative
+func (m *Manifest) name(p, path string) string {
+	if !filepath.IsLocal(strings.TrimSuffix(p, recursiveSuffix)) {
+		return path
+	}
+
+	rel, err := filepath.Rel(m.Root, path)
+	if err != nil {
+		return path
+	}
+	return rel
+}
+
+// Expand lists the names of the existing files covered by a manifest path
+func (m *Manifest) Expand(ctx context.Context, p string) ([]string, error) {
+	if IsExact(p) {
+		return []string{ p }, nil
+	}
+
+	var names []string
+
+	if IsGlob(p) {
+		paths, err := filepath.Glob(m.Resolve(ctx, p))
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			if n := m.name(p, path); !m.Excluded(n) {
+				names = append(names, n)
+			}
+		}
+		return names, nil
+	}
+
+	base := strings.TrimSuffix(p, recursiveSuffix)
+	err := filepath.WalkDir(m.Resolve(ctx, base), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		n := m.name(p, path)
+		if m.Excluded(n) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		names = append(names, n)
+		return nil
+	})
+
+	return names, err
+}
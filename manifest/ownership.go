@@ -0,0 +1,196 @@
+package manifest
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// An IdMap maps user or group names or numeric ids of packaged entries to
+// names or numeric ids on the extracting host
+type IdMap map[string]string
+
+// ParseIdMap parses comma separated from:to pairs, or reads them (one per
+// line) from a file when prefixed by @
+func ParseIdMap(s string) (IdMap, error) {
+	m := make(IdMap)
+	return m, m.Parse(s)
+}
+
+func (m IdMap) Parse(s string) error {
+	if path, ok := strings.CutPrefix(s, "@"); ok {
+		return m.load(path)
+	}
+
+	for _, p := range strings.Split(s, ",") {
+		if err := m.add(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m IdMap) add(p string) error {
+	from, to, ok := strings.Cut(strings.TrimSpace(p), ":")
+	if !ok || from == "" || to == "" {
+		return fmt.Errorf("invalid mapping (expected from:to): %s", p)
+	}
+	m[from] = to
+	return nil
+}
+
+func (m IdMap) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for l := 1; s.Scan(); l++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := m.add(line); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, l, err)
+		}
+	}
+	return s.Err()
+}
+
+// An Override replaces the owner, group and/or mode of the extracted entries
+// matching its path
+type Override struct {
+	Path string
+	Owner string
+	Group string
+	Mode *os.FileMode
+}
+
+// ParseMode parses an octal mode, including the setuid, setgid and sticky bits
+func ParseMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode &^ 07777 != 0 {
+		return 0, fmt.Errorf("invalid mode: %s", s)
+	}
+	fm := os.FileMode(mode & 0777)
+	if mode & 04000 != 0 {
+		fm |= os.ModeSetuid
+	}
+	if mode & 02000 != 0 {
+		fm |= os.ModeSetgid
+	}
+	if mode & 01000 != 0 {
+		fm |= os.ModeSticky
+	}
+	return fm, nil
+}
+
+// overrideOwner returns the owner and group of the overrides matching the
+// entry, later ones taking precedence
+func (m *Manifest) overrideOwner(hdr *tar.Header) (owner, group string) {
+	for _, o := range m.Overrides {
+		if !matches(o.Path, hdr.Name) {
+			continue
+		}
+		if o.Owner != "" {
+			owner = o.Owner
+		}
+		if o.Group != "" {
+			group = o.Group
+		}
+	}
+	return
+}
+
+// overrideMode replaces the mode of the entry by the one of the last matching override
+func (m *Manifest) overrideMode(hdr *tar.Header) {
+	for _, o := range m.Overrides {
+		if o.Mode == nil || !matches(o.Path, hdr.Name) {
+			continue
+		}
+
+		hdr.Mode = hdr.Mode &^ 07777 | int64(o.Mode.Perm())
+		if *o.Mode & os.ModeSetuid != 0 {
+			hdr.Mode |= 04000
+		}
+		if *o.Mode & os.ModeSetgid != 0 {
+			hdr.Mode |= 02000
+		}
+		if *o.Mode & os.ModeSticky != 0 {
+			hdr.Mode |= 01000
+		}
+	}
+}
+
+// resolveId resolves an overriding name or id, or maps the packaged name and
+// id, preferring the name unless numeric
+func resolveId(override, name string, id int, idmap IdMap, numeric bool, lookup func(string) (string, error)) (int, error) {
+	if override == "" {
+		if to, ok := idmap[name]; ok && name != "" && !numeric {
+			override = to
+		} else if to, ok := idmap[strconv.Itoa(id)]; ok {
+			override = to
+		}
+	}
+
+	if override != "" {
+		if i, err := strconv.Atoi(override); err == nil {
+			return i, nil
+		}
+		s, err := lookup(override)
+		if err != nil {
+			return 0, err
+		}
+		return strconv.Atoi(s)
+	}
+
+	if name != "" && !numeric {
+		if s, err := lookup(name); err == nil {
+			if i, err := strconv.Atoi(s); err == nil {
+				return i, nil
+			}
+		}
+	}
+
+	return id, nil
+}
+
+func lookupUid(name string) (string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return u.Uid, nil
+}
+
+func lookupGid(name string) (string, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return "", err
+	}
+	return g.Gid, nil
+}
+
+// owner resolves the uid and gid of an entry using the overrides, maps and
+// names, falling back to the numeric ids
+func (m *Manifest) owner(hdr *tar.Header) (uid, gid int, err error) {
+	owner, group := m.overrideOwner(hdr)
+
+	uid, err = resolveId(owner, hdr.Uname, hdr.Uid, m.OwnerMap, m.NumericOwner, lookupUid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to resolve owner of %s: %v", hdr.Name, err)
+	}
+
+	gid, err = resolveId(group, hdr.Gname, hdr.Gid, m.GroupMap, m.NumericOwner, lookupGid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to resolve group of %s: %v", hdr.Name, err)
+	}
+
+	return
+}
@@ -0,0 +1,264 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"rootmos.io/go-utils/logging"
+)
+
+// Manifest files contain one entry per line:
+//
+//	# a comment
+//	etc/app.conf
+//	"etc/file with spaces" mode=0644
+//	/etc/app/secret.key mode=0600 owner=app group=app optional
+//	etc/app recursive noreplace
+//	!etc/app/cache/**
+//	hook post etc/app/** systemctl reload app
+//	include common.manifest roles/*.manifest
+//
+// A line is taken verbatim as a path (as before attributes were introduced)
+// unless it starts with a quote or is followed by attributes only, so bare
+// paths may contain spaces, quotes, backslashes and #. Other than that, lines
+// starting with # or !, and the hook and include directives are interpreted.
+//
+// A path may be followed by attributes:
+//   - mode=, owner=, group=: override the packaged metadata when extracting
+//   - optional: the path may be missing (see IgnoreMissing)
+//   - recursive: include everything below the path (same as path/**)
+//   - noreplace: don't overwrite existing files when extracting
+//   - template: render the file when extracting (see Facts)
+//
+// Variables are expanded in paths, attributes and hook patterns (see Vars).
+//
+// Included manifests (paths or globs relative to the including file) are
+// loaded in place, see include.go.
+
+// fields splits a line into whitespace separated fields, honoring double
+// quotes and backslash escapes, and dropping comments; when expanding, quoted
+// and escaped $ are escaped as $$
+func fields(line string, expand bool) (fs []string, err error) {
+	var f strings.Builder
+	inField, quoted, escaped := false, false, false
+
+	literal := func(c rune) {
+		if expand && c == '$' {
+			f.WriteRune(c)
+		}
+		f.WriteRune(c)
+	}
+
+	for _, c := range line {
+		switch {
+		case escaped:
+			literal(c)
+			escaped = false
+		case c == '\\':
+			escaped, inField = true, true
+		case c == '"':
+			quoted, inField = !quoted, true
+		case quoted:
+			literal(c)
+		case c == ' ' || c == '\t':
+			if inField {
+				fs = append(fs, f.String())
+				f.Reset()
+				inField = false
+			}
+		case c == '#' && !inField:
+			return fs, nil
+		default:
+			f.WriteRune(c)
+			inField = true
+		}
+	}
+
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash")
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inField {
+		fs = append(fs, f.String())
+	}
+	return fs, nil
+}
+
+// parseLine parses a line (at src, i.e. file:line) of a manifest file, except include directives
+func (m *Manifest) parseLine(ctx context.Context, src, line string) error {
+	logger := logging.Get(ctx)
+
+	t := strings.TrimLeft(line, " \t")
+	if t == "" || strings.HasPrefix(t, "#") {
+		return nil
+	}
+
+	if h, ok := strings.CutPrefix(t, "hook "); ok {
+		hook, err := ParseHook(h)
+		if err != nil {
+			return err
+		}
+		if hook.Pattern, err = m.Vars.Expand(ctx, hook.Pattern); err != nil {
+			return err
+		}
+		if hook.Phase != HookPre && hook.Pattern == "" {
+			return fmt.Errorf("%s hook without pattern", hook.Phase)
+		}
+		logger.DebugContext(ctx, "adding hook to manifest", "phase", hook.Phase, "pattern", hook.Pattern)
+		m.Hooks = append(m.Hooks, hook)
+		return nil
+	}
+
+	e, exclude := strings.CutPrefix(t, "!")
+	if exclude {
+		line = e
+	}
+
+	fs, err := entry(line, m.Vars != nil)
+	if err != nil {
+		return err
+	}
+	if fs, err = m.Vars.expandAll(ctx, fs); err != nil {
+		return err
+	}
+
+	p, attrs := fs[0], fs[1:]
+	if p == "" {
+		return fmt.Errorf("empty path")
+	}
+
+	if exclude {
+		if len(attrs) > 0 {
+			return fmt.Errorf("attributes on exclude: %s", p)
+		}
+		logger.DebugContext(ctx, "adding exclude to manifest", "path", p)
+		m.Exclude(p)
+		m.contributed("!" + p, src)
+		return nil
+	}
+
+	_, err = m.addEntry(ctx, src, p, attrs)
+	return err
+}
+
+// entry splits a line into a path followed by its attributes, taking the line
+// verbatim as the path unless it starts with a quote or is followed by
+// attributes only
+func entry(line string, expand bool) ([]string, error) {
+	fs, err := fields(line, expand)
+	if strings.HasPrefix(strings.TrimLeft(line, " \t"), `"`) {
+		return fs, err
+	}
+
+	if err == nil && len(fs) > 1 {
+		attrs := true
+		for _, a := range fs[1:] {
+			attrs = attrs && isAttribute(a)
+		}
+		if attrs {
+			return fs, nil
+		}
+	}
+
+	if expand {
+		// \$ remains an escaped $ when expanding
+		line = strings.ReplaceAll(line, `\$`, "$$")
+	}
+	return []string{ line }, nil
+}
+
+// isAttribute reports whether a is a known attribute (valid or not)
+func isAttribute(a string) bool {
+	if k, _, ok := strings.Cut(a, "="); ok {
+		return k == "owner" || k == "group" || k == "mode"
+	}
+	switch a {
+	case "optional", "recursive", "noreplace", "template":
+		return true
+	}
+	return false
+}
+
+// addEntry adds a path with attributes (see above) contributed by src to the
+// manifest, returning the path as added
+func (m *Manifest) addEntry(ctx context.Context, src, p string, attrs []string) (string, error) {
+	logger := logging.Get(ctx)
+
+	var o Override
+	var optional, recursive, noreplace, template bool
+	for _, a := range attrs {
+		k, v, valued := strings.Cut(a, "=")
+		if valued && v == "" {
+			return "", fmt.Errorf("empty attribute: %s", a)
+		}
+
+		switch {
+		case a == "optional":
+			optional = true
+		case a == "recursive":
+			recursive = true
+		case a == "noreplace":
+			noreplace = true
+		case a == "template":
+			template = true
+		case valued && k == "owner":
+			o.Owner = v
+		case valued && k == "group":
+			o.Group = v
+		case valued && k == "mode":
+			mode, err := ParseMode(v)
+			if err != nil {
+				return "", err
+			}
+			o.Mode = &mode
+		default:
+			return "", fmt.Errorf("unknown attribute: %s", a)
+		}
+	}
+
+	if recursive && !IsRecursive(p) {
+		p = strings.TrimSuffix(p, "/") + recursiveSuffix
+	}
+
+	if o.Owner != "" || o.Group != "" || o.Mode != nil {
+		o.Path = p
+		logger.DebugContext(ctx, "adding override to manifest", "path", p, "owner", o.Owner, "group", o.Group, "mode", o.Mode)
+		m.Overrides = append(m.Overrides, o)
+	}
+
+	if optional {
+		if m.Optional == nil {
+			m.Optional = make(map[string]bool)
+		}
+		m.Optional[p] = true
+	}
+
+	if noreplace {
+		m.NoReplace = append(m.NoReplace, p)
+	}
+
+	if template {
+		m.Templates = append(m.Templates, p)
+	}
+
+	logger.DebugContext(ctx, "adding path to manifest", "path", p, "optional", optional, "noreplace", noreplace, "template", template)
+	m.Add(p)
+	m.contributed(p, src)
+	return p, nil
+}
+
+func (m *Manifest) missingOk(p string) bool {
+	return m.IgnoreMissing || m.Optional[p]
+}
+
+func (m *Manifest) noReplace(name string) bool {
+	for _, p := range m.NoReplace {
+		if matches(p, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,31 @@
+package manifest
+
+import (
+	"archive/tar"
+	"time"
+)
+
+// Reproducible normalizes the entries of created tarballs so that identical
+// content yields byte-identical tarballs
+type Reproducible struct {
+	// modification time of every entry (e.g. SOURCE_DATE_EPOCH)
+	ModTime time.Time
+	// record every entry as owned by uid and gid 0, without names
+	NormalizeOwner bool
+}
+
+func (r *Reproducible) normalize(hdr *tar.Header) {
+	if r == nil {
+		return
+	}
+
+	hdr.ModTime = r.ModTime.UTC().Truncate(time.Second)
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	hdr.Format = tar.FormatPAX
+
+	if r.NormalizeOwner {
+		hdr.Uid, hdr.Gid = 0, 0
+		hdr.Uname, hdr.Gname = "", ""
+	}
+}
@@ -0,0 +1,223 @@
+package manifest
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sparse files are packaged in the GNU PAX 1.0 sparse format (understood by
+// archive/tar's Reader and GNU tar). Since archive/tar's Writer is unable to
+// write them, their headers are encoded here.
+
+// PAXSparseMajor is present in the PAX records of sparse files
+const PAXSparseMajor = "GNU.sparse.major"
+
+const (
+	blockSize = 512
+	// the granularity of holes created when extracting
+	holeSize = 4096
+)
+
+// A segment is a range of a file containing data
+type segment struct {
+	offset int64
+	length int64
+}
+
+func isSparse(segs []segment, size int64) bool {
+	var n int64
+	for _, s := range segs {
+		n += s.length
+	}
+	return n < size
+}
+
+func formatPAXRecord(k, v string) string {
+	size := len(k) + len(v) + 3
+	size += len(strconv.Itoa(size))
+	r := strconv.Itoa(size) + " " + k + "=" + v + "\n"
+	if len(r) != size {
+		size = len(r)
+		r = strconv.Itoa(size) + " " + k + "=" + v + "\n"
+	}
+	return r
+}
+
+func formatPAXTime(t time.Time) string {
+	s, ns := t.Unix(), t.Nanosecond()
+	if ns == 0 {
+		return strconv.FormatInt(s, 10)
+	}
+	return strings.TrimRight(fmt.Sprintf("%d.%09d", s, ns), "0")
+}
+
+func fitsOctal(x int64, width int) bool {
+	return x >= 0 && x < 1 << (3*(width-1))
+}
+
+// ustarBlock encodes a USTAR header, leaving fields not fitting empty
+func ustarBlock(name string, typeflag byte, mode int64, uid, gid int, size, mtime int64, uname, gname string) []byte {
+	b := make([]byte, blockSize)
+
+	octal := func(off, width int, x int64) {
+		if fitsOctal(x, width) {
+			copy(b[off:off+width], fmt.Sprintf("%0*o", width-1, x))
+		}
+	}
+	str := func(off, width int, s string) {
+		if len(s) <= width {
+			copy(b[off:off+width], s)
+		}
+	}
+
+	if len(name) > 100 {
+		name = name[len(name)-100:]
+	}
+	str(0, 100, name)
+	octal(100, 8, mode)
+	octal(108, 8, int64(uid))
+	octal(116, 8, int64(gid))
+	octal(124, 12, size)
+	octal(136, 12, mtime)
+	b[156] = typeflag
+	copy(b[257:265], "ustar\x0000")
+	str(265, 32, uname)
+	str(297, 32, gname)
+
+	copy(b[148:156], "        ")
+	var sum int64
+	for _, c := range b {
+		sum += int64(c)
+	}
+	copy(b[148:156], fmt.Sprintf("%06o\x00 ", sum))
+
+	return b
+}
+
+func pad(n int64) []byte {
+	return make([]byte, (blockSize - n % blockSize) % blockSize)
+}
+
+// writeSparse writes a sparse file entry, containing only the data segments
+// of the file, directly to the underlying writer of the tar.Writer
+func writeSparse(w io.Writer, tw *tar.Writer, hdr *tar.Header, f *os.File, segs []segment) error {
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	var m bytes.Buffer
+	fmt.Fprintf(&m, "%d\n", len(segs))
+	for _, s := range segs {
+		fmt.Fprintf(&m, "%d\n%d\n", s.offset, s.length)
+	}
+	m.Write(pad(int64(m.Len())))
+
+	size := int64(m.Len())
+	for _, s := range segs {
+		size += s.length
+	}
+
+	dir, file := path.Split(hdr.Name)
+	name := path.Join(dir, "GNUSparseFile.0", file)
+
+	records := make(map[string]string)
+	for k, v := range hdr.PAXRecords {
+		records[k] = v
+	}
+	records[PAXSparseMajor] = "1"
+	records["GNU.sparse.minor"] = "0"
+	records["GNU.sparse.name"] = hdr.Name
+	records["GNU.sparse.realsize"] = strconv.FormatInt(hdr.Size, 10)
+	if hdr.ModTime.Nanosecond() != 0 || !fitsOctal(hdr.ModTime.Unix(), 12) {
+		records["mtime"] = formatPAXTime(hdr.ModTime)
+	}
+	if !hdr.AccessTime.IsZero() {
+		records["atime"] = formatPAXTime(hdr.AccessTime)
+	}
+	if !fitsOctal(int64(hdr.Uid), 8) {
+		records["uid"] = strconv.Itoa(hdr.Uid)
+	}
+	if !fitsOctal(int64(hdr.Gid), 8) {
+		records["gid"] = strconv.Itoa(hdr.Gid)
+	}
+	if len(hdr.Uname) > 32 {
+		records["uname"] = hdr.Uname
+	}
+	if len(hdr.Gname) > 32 {
+		records["gname"] = hdr.Gname
+	}
+	if !fitsOctal(size, 12) {
+		records["size"] = strconv.FormatInt(size, 10)
+	}
+
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pax bytes.Buffer
+	for _, k := range keys {
+		pax.WriteString(formatPAXRecord(k, records[k]))
+	}
+
+	paxName := path.Join(dir, "PaxHeaders.0", file)
+	if _, err := w.Write(ustarBlock(paxName, tar.TypeXHeader, 0, 0, 0, int64(pax.Len()), 0, "", "")); err != nil {
+		return err
+	}
+	if _, err := w.Write(append(pax.Bytes(), pad(int64(pax.Len()))...)); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(ustarBlock(name, tar.TypeReg, hdr.Mode, hdr.Uid, hdr.Gid, size, hdr.ModTime.Unix(), hdr.Uname, hdr.Gname)); err != nil {
+		return err
+	}
+	if _, err := w.Write(m.Bytes()); err != nil {
+		return err
+	}
+
+	for _, s := range segs {
+		if _, err := io.Copy(w, io.NewSectionReader(f, s.offset, s.length)); err != nil {
+			return err
+		}
+	}
+
+	_, err := w.Write(pad(size))
+	return err
+}
+
+// copySparse writes the content to the (empty) file, seeking past blocks of
+// zeros leaving holes
+func copySparse(f *os.File, r io.Reader) (n int64, err error) {
+	buf := make([]byte, holeSize)
+	for {
+		k, err := io.ReadFull(r, buf)
+		if k > 0 {
+			if bytes.Count(buf[:k], []byte{ 0 }) == k {
+				_, err = f.Seek(int64(k), io.SeekCurrent)
+			} else {
+				_, err = f.Write(buf[:k])
+			}
+			if err != nil {
+				return n, err
+			}
+			n += int64(k)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, f.Truncate(n)
+}
@@ -0,0 +1,48 @@
+package manifest
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// dataSegments lists the data segments of a file using SEEK_DATA/SEEK_HOLE
+func dataSegments(f *os.File, size int64) (segs []segment, err error) {
+	defer func() {
+		if _, e := f.Seek(0, io.SeekStart); err == nil {
+			err = e
+		}
+	}()
+
+	var off int64
+	for off < size {
+		data, err := f.Seek(off, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		hole, err := f.Seek(data, seekHole)
+		if err != nil {
+			return nil, err
+		}
+
+		segs = append(segs, segment{ offset: data, length: hole - data })
+		off = hole
+	}
+
+	if off < size {
+		// a trailing hole is marked by an empty segment at the end
+		segs = append(segs, segment{ offset: size })
+	}
+
+	return segs, nil
+}
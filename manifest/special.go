@@ -0,0 +1,145 @@
+package manifest
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"rootmos.io/go-utils/logging"
+)
+
+// SpecialPolicy decides how device nodes, FIFOs and sockets are handled
+type SpecialPolicy int
+
+const (
+	// package and extract devices and FIFOs, skipping sockets with a warning
+	SpecialInclude SpecialPolicy = iota
+	// skip special files with a warning
+	SpecialSkip
+	// fail on special files
+	SpecialError
+)
+
+func ParseSpecialPolicy(s string) (SpecialPolicy, error) {
+	switch strings.ToLower(s) {
+	case "", "include":
+		return SpecialInclude, nil
+	case "skip":
+		return SpecialSkip, nil
+	case "error":
+		return SpecialError, nil
+	}
+	return 0, fmt.Errorf("unsupported special files policy: %s", s)
+}
+
+func (p SpecialPolicy) String() string {
+	switch p {
+	case SpecialInclude:
+		return "include"
+	case SpecialSkip:
+		return "skip"
+	case SpecialError:
+		return "error"
+	}
+	return fmt.Sprintf("SpecialPolicy(%d)", int(p))
+}
+
+const specialModes = os.ModeDevice | os.ModeCharDevice | os.ModeNamedPipe | os.ModeSocket
+
+func isSpecial(mode os.FileMode) bool {
+	return mode & specialModes != 0
+}
+
+func isSpecialType(typeflag byte) bool {
+	return typeflag == tar.TypeChar || typeflag == tar.TypeBlock || typeflag == tar.TypeFifo
+}
+
+// includeSpecial applies the policy to a special file, reporting whether it
+// should be included
+func (m *Manifest) includeSpecial(ctx context.Context, name string, mode os.FileMode) (bool, error) {
+	logger := logging.Get(ctx)
+
+	switch m.Special {
+	case SpecialError:
+		return false, fmt.Errorf("special file: %s (%v)", name, mode.Type())
+	case SpecialSkip:
+		logger.WarnContext(ctx, "skipping special file", "name", name, "type", mode.Type())
+		return false, nil
+	}
+
+	if mode & os.ModeSocket != 0 {
+		logger.WarnContext(ctx, "skipping socket", "name", name)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// skippedHeader records the exact paths of the manifest skipped when creating,
+// which are then not required when extracting
+func skippedHeader(names []string) *tar.Header {
+	return &tar.Header {
+		Typeflag: tar.TypeXGlobalHeader,
+		Format: tar.FormatPAX,
+		PAXRecords: map[string]string {
+			PAXSkipped: strings.Join(names, "\x00"),
+		},
+	}
+}
+
+func skippedNames(hdr *tar.Header) []string {
+	if s := hdr.PAXRecords[PAXSkipped]; s != "" {
+		return strings.Split(s, "\x00")
+	}
+	return nil
+}
+
+// mknod creates a device node or FIFO, unless an identical one exists,
+// skipping device nodes when not privileged
+func (m *Manifest) mknod(ctx context.Context, path string, hdr *tar.Header, changed map[string]bool) (bool, error) {
+	logger := logging.Get(ctx)
+
+	var mode uint32
+	switch hdr.Typeflag {
+	case tar.TypeChar:
+		mode = syscall.S_IFCHR
+	case tar.TypeBlock:
+		mode = syscall.S_IFBLK
+	case tar.TypeFifo:
+		mode = syscall.S_IFIFO
+	}
+	mode |= uint32(hdr.FileInfo().Mode().Perm())
+	dev := mkdev(uint64(hdr.Devmajor), uint64(hdr.Devminor))
+
+	var st syscall.Stat_t
+	err := syscall.Lstat(path, &st)
+	if err == nil && uint32(st.Mode) & syscall.S_IFMT == mode & syscall.S_IFMT && uint64(st.Rdev) == uint64(dev) {
+		return true, nil
+	}
+	if err == nil {
+		if err := os.Remove(path); err != nil {
+			return false, err
+		}
+	} else if !errors.Is(err, syscall.ENOENT) {
+		return false, &os.PathError{ Op: "lstat", Path: path, Err: err }
+	}
+
+	oldmask := syscall.Umask(0)
+	err = syscall.Mknod(path, mode, dev)
+	syscall.Umask(oldmask)
+	if errors.Is(err, syscall.EPERM) && hdr.Typeflag != tar.TypeFifo {
+		logger.WarnContext(ctx, "not privileged to create device node; skipping", "name", hdr.Name)
+		return false, nil
+	}
+	if err != nil {
+		return false, &os.PathError{ Op: "mknod", Path: path, Err: err }
+	}
+
+	changed[hdr.Name] = true
+	logger.InfoContext(ctx, "extracted special file", "name", hdr.Name, "major", hdr.Devmajor, "minor", hdr.Devminor)
+	return true, nil
+}
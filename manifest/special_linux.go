@@ -0,0 +1,5 @@
+package manifest
+
+func mkdev(major, minor uint64) int {
+	return int((minor & 0xff) | ((major & 0xfff) << 8) | ((minor &^ 0xff) << 12) | ((major &^ 0xfff) << 32))
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package manifest
+
+func mkdev(major, minor uint64) int {
+	return int(major << 24 | minor)
+}
@@ -0,0 +1,262 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"rootmos.io/go-utils/logging"
+)
+
+// A Document is a structured manifest (JSON, YAML or TOML) fully describing
+// a package, e.g.:
+//
+//	root: /
+//	destination: s3://bucket/app.tar.gz
+//	gzip: 9
+//	key: awssm://arn:aws:secretsmanager:...
+//	owner: root
+//	group: root
+//	groups:
+//	  nginx:
+//	    paths: [ etc/nginx ]
+//	    recursive: true
+//	    excludes: [ "etc/nginx/*.bak" ]
+//	    hooks:
+//	      - phase: post
+//	        command: nginx -t && systemctl reload nginx
+type Document struct {
+	// relative to the directory of the document
+	Root string `json:"root" yaml:"root" toml:"root"`
+
+	Package `yaml:",inline"`
+
+	// default ownership of the entries of all groups
+	Owner string `json:"owner" yaml:"owner" toml:"owner"`
+	Group string `json:"group" yaml:"group" toml:"group"`
+	Mode string `json:"mode" yaml:"mode" toml:"mode"`
+
+	Hooks []DocumentHook `json:"hooks" yaml:"hooks" toml:"hooks"`
+	Groups map[string]DocumentGroup `json:"groups" yaml:"groups" toml:"groups"`
+}
+
+// Package holds the settings of a structured manifest used when creating or
+// extracting it, unless overridden by flags
+type Package struct {
+	Destination string `json:"destination" yaml:"destination" toml:"destination"`
+	// gzip compression level
+	Gzip *int `json:"gzip" yaml:"gzip" toml:"gzip"`
+	// URL of the encryption key (see keyprovider)
+	Key string `json:"key" yaml:"key" toml:"key"`
+}
+
+type DocumentGroup struct {
+	Paths []string `json:"paths" yaml:"paths" toml:"paths"`
+	Excludes []string `json:"excludes" yaml:"excludes" toml:"excludes"`
+
+	Owner string `json:"owner" yaml:"owner" toml:"owner"`
+	Group string `json:"group" yaml:"group" toml:"group"`
+	Mode string `json:"mode" yaml:"mode" toml:"mode"`
+	Optional bool `json:"optional" yaml:"optional" toml:"optional"`
+	Recursive bool `json:"recursive" yaml:"recursive" toml:"recursive"`
+	NoReplace bool `json:"noreplace" yaml:"noreplace" toml:"noreplace"`
+	Template bool `json:"template" yaml:"template" toml:"template"`
+
+	// hooks without a pattern are triggered by the paths of the group
+	Hooks []DocumentHook `json:"hooks" yaml:"hooks" toml:"hooks"`
+}
+
+type DocumentHook struct {
+	Phase HookPhase `json:"phase" yaml:"phase" toml:"phase"`
+	Pattern string `json:"pattern" yaml:"pattern" toml:"pattern"`
+	Command string `json:"command" yaml:"command" toml:"command"`
+}
+
+// IsStructured reports whether the path has the extension of a structured manifest
+func IsStructured(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json", ".yaml", ".yml", ".toml":
+		return true
+	}
+	return false
+}
+
+func decodeDocument(path string) (d Document, err error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(bs))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&d)
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(bs))
+		dec.KnownFields(true)
+		err = dec.Decode(&d)
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(bs), &d)
+		if err == nil && len(md.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown field: %s", md.Undecoded()[0])
+		}
+	default:
+		err = fmt.Errorf("unsupported manifest format: %s", path)
+	}
+
+	if err != nil {
+		err = fmt.Errorf("%s: %v", path, err)
+	}
+	return
+}
+
+func (h DocumentHook) hook(ctx context.Context, vars *Vars, patterns []string) (Hook, error) {
+	switch h.Phase {
+	case HookPre, HookValidate, HookPost:
+	default:
+		return Hook{}, fmt.Errorf("unsupported hook phase: %s", h.Phase)
+	}
+	if h.Command == "" {
+		return Hook{}, fmt.Errorf("hook without command")
+	}
+
+	pattern, err := vars.Expand(ctx, h.Pattern)
+	if err != nil {
+		return Hook{}, err
+	}
+
+	hook := Hook {
+		Phase: h.Phase,
+		Pattern: pattern,
+		Command: h.Command,
+	}
+	if h.Phase != HookPre && pattern == "" {
+		if len(patterns) == 0 {
+			return Hook{}, fmt.Errorf("%s hook without pattern", h.Phase)
+		}
+		hook.Patterns = patterns
+	}
+	return hook, nil
+}
+
+func attrs(owner, group, mode string) (as []string) {
+	if owner != "" {
+		as = append(as, "owner=" + owner)
+	}
+	if group != "" {
+		as = append(as, "group=" + group)
+	}
+	if mode != "" {
+		as = append(as, "mode=" + mode)
+	}
+	return
+}
+
+// loadDocument loads a structured manifest, the groups being added in order
+// of their names, expanding the variables of the root, destination, key, paths,
+// excludes, attributes and hook patterns
+func loadDocument(ctx context.Context, path, root string, vars *Vars) (*Manifest, error) {
+	d, err := decodeDocument(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range []*string{ &d.Root, &d.Destination, &d.Key } {
+		if *s, err = vars.Expand(ctx, *s); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	m := &Manifest {
+		Root: root,
+		Package: &d.Package,
+		Vars: vars,
+	}
+	if d.Root != "" {
+		m.Root = d.Root
+		if !filepath.IsAbs(m.Root) {
+			m.Root = filepath.Join(filepath.Dir(path), m.Root)
+		}
+	}
+
+	for _, h := range d.Hooks {
+		hook, err := h.hook(ctx, vars, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		m.Hooks = append(m.Hooks, hook)
+	}
+
+	var names []string
+	for n := range d.Groups {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	defaults := attrs(d.Owner, d.Group, d.Mode)
+	for _, n := range names {
+		g := d.Groups[n]
+		logger, ctx := logging.WithAttrs(ctx, "group", n)
+		logger.DebugContext(ctx, "adding group to manifest")
+
+		// the attributes of the group take precedence over the defaults
+		as := append(append([]string{}, defaults...), attrs(g.Owner, g.Group, g.Mode)...)
+		if g.Optional {
+			as = append(as, "optional")
+		}
+		if g.Recursive {
+			as = append(as, "recursive")
+		}
+		if g.NoReplace {
+			as = append(as, "noreplace")
+		}
+		if g.Template {
+			as = append(as, "template")
+		}
+
+		if as, err = vars.expandAll(ctx, as); err != nil {
+			return nil, fmt.Errorf("%s: group %s: %v", path, n, err)
+		}
+		ps, err := vars.expandAll(ctx, g.Paths)
+		if err != nil {
+			return nil, fmt.Errorf("%s: group %s: %v", path, n, err)
+		}
+		es, err := vars.expandAll(ctx, g.Excludes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: group %s: %v", path, n, err)
+		}
+
+		var patterns []string
+		for _, p := range ps {
+			q, err := m.addEntry(ctx, path, p, as)
+			if err != nil {
+				return nil, fmt.Errorf("%s: group %s: %v", path, n, err)
+			}
+			patterns = append(patterns, q)
+		}
+
+		for _, e := range es {
+			m.Exclude(e)
+			m.contributed("!" + e, path)
+		}
+
+		for _, h := range g.Hooks {
+			hook, err := h.hook(ctx, vars, patterns)
+			if err != nil {
+				return nil, fmt.Errorf("%s: group %s: %v", path, n, err)
+			}
+			m.Hooks = append(m.Hooks, hook)
+		}
+	}
+
+	return m, nil
+}
@@ -0,0 +1,142 @@
+package manifest
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"rootmos.io/go-utils/logging"
+)
+
+// sync removes the files covered by the recursive and glob paths of the
+// manifest which were not extracted, deepest first, recording them as changed
+func (m *Manifest) sync(ctx context.Context, extracted map[string]bool, u *undo, changed map[string]bool) error {
+	stale := make(map[string]bool)
+	for _, p := range m.Paths {
+		if IsExact(p) {
+			continue
+		}
+
+		names, err := m.Expand(ctx, p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, n := range names {
+			if !extracted[n] && m.Match(n) {
+				stale[n] = true
+			}
+		}
+	}
+
+	var names []string
+	for n := range stale {
+		names = append(names, n)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	for _, n := range names {
+		path := m.Resolve(ctx, n)
+		logger, ctx := logging.WithAttrs(ctx, "name", n, "path", path)
+
+		// globs follow symlinked directories, possibly outside the root
+		if err := m.checkParents(n); err != nil {
+			logger.WarnContext(ctx, "not removing stale file", "err", err)
+			continue
+		}
+
+		fi, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := u.save(ctx, path, n); err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			if err := os.Remove(path); err != nil {
+				logger.DebugContext(ctx, "keeping non-empty directory", "err", err)
+				continue
+			}
+			changed[n] = true
+			logger.InfoContext(ctx, "removed stale directory")
+			continue
+		}
+
+		changed[n] = true
+
+		if m.BackupDir != "" {
+			if err := m.backup(path, n); err != nil {
+				return err
+			}
+			logger.InfoContext(ctx, "moved stale file to backup", "backup", m.BackupDir)
+			continue
+		}
+
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		logger.InfoContext(ctx, "removed stale file")
+	}
+
+	return nil
+}
+
+func (m *Manifest) backup(path, name string) error {
+	dst := filepath.Join(m.BackupDir, strings.TrimPrefix(filepath.Clean(name), "/"))
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+
+	if err := os.Rename(path, dst); err == nil {
+		return nil
+	}
+
+	// most likely across filesystems
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode().Type() == os.ModeSymlink {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, dst); err != nil {
+			return err
+		}
+		return os.Remove(path)
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, src); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
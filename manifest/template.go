@@ -0,0 +1,88 @@
+package manifest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"text/template"
+)
+
+// Facts are the data of the templates rendered when extracting, e.g.:
+//
+//	server_name {{ .Hostname }};
+//	worker_processes {{ .NumCPU }};
+//	root /srv/{{ .Vars.ENV }};
+type Facts struct {
+	Hostname string
+	OS string
+	Arch string
+	NumCPU int
+	Env map[string]string
+	Vars map[string]string
+}
+
+func (m *Manifest) facts() (f Facts, err error) {
+	f.Hostname, err = os.Hostname()
+	if err != nil {
+		return
+	}
+	f.OS, f.Arch, f.NumCPU = runtime.GOOS, runtime.GOARCH, runtime.NumCPU()
+
+	f.Env = make(map[string]string)
+	for _, e := range os.Environ() {
+		k, v, _ := strings.Cut(e, "=")
+		f.Env[k] = v
+	}
+
+	f.Vars = make(map[string]string)
+	if m.Vars != nil {
+		for k, v := range m.Vars.Values {
+			f.Vars[k] = v
+		}
+	}
+	return
+}
+
+// marks the entries created as templates, rendered whichever manifest they are extracted with
+const PAXTemplate = "SITEPKG.template"
+
+func (m *Manifest) isTemplate(name string) bool {
+	for _, p := range m.Templates {
+		if matches(p, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// render executes the template read from r (missing keys being errors),
+// returning the size and SHA256 of the rendered content written to w
+func (m *Manifest) render(name string, w io.Writer, r io.Reader) (n int64, digest string, err error) {
+	bs, err := io.ReadAll(r)
+	if err != nil {
+		return
+	}
+
+	t, err := template.New(name).Option("missingkey=error").Parse(string(bs))
+	if err != nil {
+		return
+	}
+
+	facts, err := m.facts()
+	if err != nil {
+		return
+	}
+
+	var b bytes.Buffer
+	if err = t.Execute(&b, facts); err != nil {
+		return
+	}
+
+	dgst := sha256.Sum256(b.Bytes())
+	n, err = io.Copy(w, &b)
+	return n, hex.EncodeToString(dgst[:]), err
+}
@@ -0,0 +1,28 @@
+package manifest
+
+import (
+	"archive/tar"
+	"os"
+	"time"
+)
+
+func atime(hdr *tar.Header) time.Time {
+	if hdr.AccessTime.IsZero() {
+		return hdr.ModTime
+	}
+	return hdr.AccessTime
+}
+
+// chtimes restores the access and modification times of an extracted entry,
+// without following symlinks
+func chtimes(path string, hdr *tar.Header) error {
+	if hdr.ModTime.IsZero() {
+		return nil
+	}
+
+	if hdr.Typeflag == tar.TypeSymlink {
+		return lutimes(path, atime(hdr), hdr.ModTime)
+	}
+
+	return os.Chtimes(path, atime(hdr), hdr.ModTime)
+}
@@ -0,0 +1,34 @@
+package manifest
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	atFdcwd = -0x64
+	atSymlinkNofollow = 0x100
+)
+
+func lutimes(path string, atime, mtime time.Time) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+
+	ts := [2]syscall.Timespec{
+		syscall.NsecToTimespec(atime.UnixNano()),
+		syscall.NsecToTimespec(mtime.UnixNano()),
+	}
+
+	dirfd := atFdcwd
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT,
+		uintptr(dirfd), uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&ts[0])),
+		atSymlinkNofollow, 0, 0)
+	if errno != 0 {
+		return &os.PathError{ Op: "lutimes", Path: path, Err: errno }
+	}
+	return nil
+}
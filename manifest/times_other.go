@@ -0,0 +1,12 @@
+//go:build !linux
+
+package manifest
+
+import (
+	"time"
+)
+
+// lutimes is a no-op where utimensat is unavailable
+func lutimes(path string, atime, mtime time.Time) error {
+	return nil
+}
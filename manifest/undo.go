@@ -0,0 +1,130 @@
+package manifest
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+
+	"rootmos.io/go-utils/logging"
+)
+
+type undoEntry struct {
+	hdr *tar.Header
+	content []byte
+}
+
+// undo records the state of paths before they are modified, producing a
+// tarball which when extracted restores that state
+type undo struct {
+	entries []undoEntry
+	saved map[string]bool
+}
+
+func newUndo() *undo {
+	return &undo {
+		saved: make(map[string]bool),
+	}
+}
+
+func (u *undo) save(ctx context.Context, path, name string) error {
+	if u == nil || u.saved[name] {
+		return nil
+	}
+	u.saved[name] = true
+
+	logger := logging.Get(ctx)
+
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		logger.DebugContext(ctx, "undo: remove", "name", name)
+		u.entries = append(u.entries, undoEntry{ hdr: whiteout(name) })
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var link string
+	if fi.Mode().Type() == os.ModeSymlink {
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+
+	var content []byte
+	if fi.Mode().IsRegular() {
+		if content, err = os.ReadFile(path); err != nil {
+			return err
+		}
+	}
+
+	logger.DebugContext(ctx, "undo: restore", "name", name, "bytes", len(content))
+	u.entries = append(u.entries, undoEntry{ hdr: hdr, content: content })
+	return nil
+}
+
+// writeTo writes the entries in reverse order, so that files are restored
+// (or removed) before their parent directories
+func (u *undo) writeTo(w io.Writer) (err error) {
+	tw := tar.NewWriter(w)
+	defer func() {
+		if e := tw.Close(); err == nil {
+			err = e
+		}
+	}()
+
+	for i := len(u.entries) - 1; i >= 0; i-- {
+		e := u.entries[i]
+		if err = tw.WriteHeader(e.hdr); err != nil {
+			return
+		}
+		if _, err = io.Copy(tw, bytes.NewReader(e.content)); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Rollback extracts an undo tarball, written during a previous extraction,
+// relative to the root
+func Rollback(ctx context.Context, root string, r io.Reader) error {
+	bs, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	m := &Manifest {
+		Root: root,
+		IgnoreMissing: true,
+	}
+
+	tr := tar.NewReader(bytes.NewReader(bs))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name, ok, err := Whiteout(hdr)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			name = hdr.Name
+		}
+		m.Add(name)
+	}
+
+	return m.Extract(ctx, bytes.NewReader(bs))
+}
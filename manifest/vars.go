@@ -0,0 +1,81 @@
+package manifest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"rootmos.io/go-utils/logging"
+)
+
+// Vars, when specified, are expanded in the paths, excludes, attributes,
+// includes and hook patterns of manifests ($VAR or ${VAR}; $$, \$ or a quoted $
+// for a literal $), taking precedence over the environment
+type Vars struct {
+	Values map[string]string
+	// fail on undefined variables instead of expanding them (with a warning) to the empty string
+	Strict bool
+}
+
+// Parse adds a variable specified as k=v
+func (v *Vars) Parse(s string) error {
+	k, x, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("invalid variable: %s", s)
+	}
+	if v.Values == nil {
+		v.Values = make(map[string]string)
+	}
+	v.Values[k] = x
+	return nil
+}
+
+func (v *Vars) lookup(k string) (string, bool) {
+	if v != nil {
+		if x, ok := v.Values[k]; ok {
+			return x, true
+		}
+	}
+	return os.LookupEnv(k)
+}
+
+// Expand expands the variables in s, unless v is nil
+func (v *Vars) Expand(ctx context.Context, s string) (string, error) {
+	if v == nil {
+		return s, nil
+	}
+
+	var err error
+	r := os.Expand(s, func(k string) string {
+		if k == "$" {
+			return "$"
+		}
+		if x, ok := v.lookup(k); ok {
+			return x
+		}
+		if v.Strict {
+			if err == nil {
+				err = fmt.Errorf("undefined variable: %s", k)
+			}
+		} else {
+			logging.Get(ctx).WarnContext(ctx, "undefined variable", "var", k, "in", s)
+		}
+		return ""
+	})
+	return r, err
+}
+
+func (v *Vars) expandAll(ctx context.Context, ss []string) (rs []string, err error) {
+	if v == nil {
+		return ss, nil
+	}
+	for _, s := range ss {
+		r, err := v.Expand(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+	return
+}
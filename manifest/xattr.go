@@ -0,0 +1,131 @@
+package manifest
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+
+	"rootmos.io/go-utils/logging"
+)
+
+// PAXXattrPrefix is the prefix of PAX records holding extended attributes (as used by GNU tar and archive/tar)
+const PAXXattrPrefix = "SCHILY.xattr."
+
+var DefaultXattrIncludes = []string{
+	"user.*",
+	"security.selinux",
+	"system.posix_acl_access",
+	"system.posix_acl_default",
+	"security.capability",
+}
+
+// Xattrs selects the extended attributes captured and restored by patterns
+// (see path.Match) of their names, e.g. user.* or security.selinux
+type Xattrs struct {
+	Include []string
+	Exclude []string
+}
+
+func (x *Xattrs) Match(name string) bool {
+	if x == nil {
+		return false
+	}
+
+	for _, p := range x.Exclude {
+		if ok, _ := path.Match(p, name); ok {
+			return false
+		}
+	}
+
+	for _, p := range x.Include {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func unsupported(err error) bool {
+	return errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EOPNOTSUPP)
+}
+
+// privileged reports whether setting the extended attribute requires
+// privileges the extracting user may lack (e.g. when not root)
+func privileged(name string) bool {
+	return strings.HasPrefix(name, "security.") || strings.HasPrefix(name, "trusted.") || strings.HasPrefix(name, "system.posix_acl_")
+}
+
+func denied(err error) bool {
+	return errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES)
+}
+
+// capture records the selected extended attributes of the file as PAX records
+func (x *Xattrs) capture(ctx context.Context, p string, hdr *tar.Header) error {
+	if x == nil || hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+
+	names, err := listxattr(p)
+	if unsupported(err) {
+		logging.Get(ctx).DebugContext(ctx, "extended attributes not supported", "path", p)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		if !x.Match(n) {
+			continue
+		}
+
+		v, err := getxattr(p, n)
+		if err != nil {
+			return err
+		}
+
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords[PAXXattrPrefix + n] = string(v)
+	}
+
+	return nil
+}
+
+// restore sets the selected extended attributes recorded in the header,
+// warning when the filesystem doesn't support them or when not permitted to
+// set privileged ones
+func (x *Xattrs) restore(ctx context.Context, p string, hdr *tar.Header) error {
+	if x == nil || hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+
+	for k, v := range hdr.PAXRecords {
+		n, ok := strings.CutPrefix(k, PAXXattrPrefix)
+		if !ok || !x.Match(n) {
+			continue
+		}
+
+		err := setxattr(p, n, []byte(v))
+		if unsupported(err) {
+			logging.Get(ctx).WarnContext(ctx, "extended attributes not supported; skipping", "path", p, "xattr", n)
+			continue
+		}
+		if denied(err) && privileged(n) {
+			logging.Get(ctx).WarnContext(ctx, "not permitted to set extended attribute; skipping", "path", p, "xattr", n, "err", err)
+			continue
+		}
+		if err != nil {
+			return &os.PathError{ Op: "setxattr " + n, Path: p, Err: err }
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package manifest
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+)
+
+func listxattr(p string) ([]string, error) {
+	for {
+		sz, err := syscall.Listxattr(p, nil)
+		if err != nil || sz == 0 {
+			return nil, err
+		}
+
+		buf := make([]byte, sz)
+		sz, err = syscall.Listxattr(p, buf)
+		if errors.Is(err, syscall.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var names []string
+		for _, n := range strings.Split(string(buf[:sz]), "\x00") {
+			if n != "" {
+				names = append(names, n)
+			}
+		}
+		return names, nil
+	}
+}
+
+func getxattr(p, name string) ([]byte, error) {
+	for {
+		sz, err := syscall.Getxattr(p, name, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, sz)
+		sz, err = syscall.Getxattr(p, name, buf)
+		if errors.Is(err, syscall.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:sz], nil
+	}
+}
+
+func setxattr(p, name string, v []byte) error {
+	return syscall.Setxattr(p, name, v, 0)
+}
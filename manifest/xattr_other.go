@@ -0,0 +1,19 @@
+//go:build !linux
+
+package manifest
+
+import (
+	"syscall"
+)
+
+func listxattr(p string) ([]string, error) {
+	return nil, syscall.ENOTSUP
+}
+
+func getxattr(p, name string) ([]byte, error) {
+	return nil, syscall.ENOTSUP
+}
+
+func setxattr(p, name string, v []byte) error {
+	return syscall.ENOTSUP
+}